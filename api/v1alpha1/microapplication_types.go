@@ -17,6 +17,8 @@ limitations under the License.
 package v1alpha1
 
 import (
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -28,26 +30,365 @@ type MicroApplicationSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// RepoURL is the URL to the repository (Git or Helm) that contains the application manifests
+	// RepoURL is the URL to the repository (Git or Helm) that contains the application manifests. It is a Helm
+	// chart repository when spec.helm.chart is set.
 	RepoURL string `json:"repoURL"`
 	// Path is a directory path within the Git repository, and is only valid for applications sourced from Git.
 	Path string `json:"path,omitempty"`
 	// TargetRevision defines the revision of the source to sync the application to.
 	// In case of Git, this can be commit, tag, or branch. If omitted, will equal to HEAD.
-	// In case of Helm, this is a semver tag for the Chart's version.
+	// In case of Helm, this is a semver tag or range for the Chart's version. If omitted, will equal to the
+	// latest stable version.
 	TargetRevision string `json:"targetRevision,omitempty"`
+	// Source holds options for accessing RepoURL.
+	Source *SourceOptions `json:"source,omitempty"`
+	// Destination tells where the resources are applied.
+	Destination *Destination `json:"destination,omitempty"`
+	// Kustomize holds options for rendering Path with kustomize. Path is always rendered with kustomize when it
+	// contains a kustomization file, setting this renders it with kustomize even when it doesn't.
+	Kustomize *KustomizeOptions `json:"kustomize,omitempty"`
+	// Helm renders a Helm chart, either the one at Path in the Git repository or one fetched from the chart
+	// repository at RepoURL. It can't be set along with Kustomize.
+	Helm *HelmOptions `json:"helm,omitempty"`
+	// SyncPolicy controls how the application is synced.
+	SyncPolicy *SyncPolicy `json:"syncPolicy,omitempty"`
+	// DeletionPolicy tells what happens to the resources of the application when it is deleted: Delete deletes
+	// them on behalf of the creator, Orphan (the default) leaves them in the cluster.
+	// +kubebuilder:default=Orphan
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// RevisionHistoryLimit is the maximum number of entries kept in status.history. Defaults to 10.
+	// +kubebuilder:validation:Minimum=0
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+	// Creator is the user who created the application, which resources are synced on behalf of. It is
+	// recorded by the mutating webhook, overwriting whatever was set, and can't be changed afterwards.
+	Creator *authenticationv1.UserInfo `json:"creator,omitempty"`
 }
 
+// DeletionPolicy tells what happens to the resources of a deleted application.
+// +kubebuilder:validation:Enum=Delete;Orphan
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes every resource in the inventory along with the application.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyOrphan leaves the resources in the cluster.
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+)
+
+// Destination tells where the resources of an application are applied
+type Destination struct {
+	// Namespace is the namespace namespaced resources without a namespace are applied to. Defaults to the
+	// namespace of the MicroApplication. When cross-namespace resources aren't allowed, it has to be the
+	// namespace of the MicroApplication or one of the destination namespaces of its project.
+	Namespace string `json:"namespace,omitempty"`
+	// RewriteNamespaces moves the resources targeting another namespace to Namespace when cross-namespace
+	// resources aren't allowed, instead of refusing to sync them.
+	RewriteNamespaces bool `json:"rewriteNamespaces,omitempty"`
+}
+
+// SourceOptions holds options for accessing the repository
+type SourceOptions struct {
+	// SecretRef names a Secret in the namespace of the MicroApplication holding the credentials for RepoURL:
+	// username and password or token for HTTPS, sshPrivateKey and known_hosts for SSH.
+	// The creator of the MicroApplication must be allowed to get this Secret.
+	SecretRef *corev1.LocalObjectReference `json:"secretRef,omitempty"`
+}
+
+// KustomizeOptions are applied on top of the kustomization found in the source
+type KustomizeOptions struct {
+	// NamePrefix is prepended to the name of every resource.
+	NamePrefix string `json:"namePrefix,omitempty"`
+	// NameSuffix is appended to the name of every resource.
+	NameSuffix string `json:"nameSuffix,omitempty"`
+	// CommonLabels are added to every resource and selector.
+	CommonLabels map[string]string `json:"commonLabels,omitempty"`
+	// CommonAnnotations are added to every resource.
+	CommonAnnotations map[string]string `json:"commonAnnotations,omitempty"`
+	// Images overrides the name, tag or digest of container images.
+	Images []KustomizeImage `json:"images,omitempty"`
+}
+
+// KustomizeImage overrides a container image, like the images field of a kustomization
+type KustomizeImage struct {
+	// Name is the tag-less name of the image to override.
+	Name string `json:"name"`
+	// NewName replaces the name of the image.
+	NewName string `json:"newName,omitempty"`
+	// NewTag replaces the tag of the image.
+	NewTag string `json:"newTag,omitempty"`
+	// Digest replaces the tag of the image, NewTag is ignored when it's set.
+	Digest string `json:"digest,omitempty"`
+}
+
+// HelmOptions tell how a Helm chart is rendered
+type HelmOptions struct {
+	// Chart is the name of the chart to fetch from the chart repository at RepoURL. When empty, the chart is
+	// the directory at Path in the Git repository at RepoURL.
+	Chart string `json:"chart,omitempty"`
+	// ReleaseName is the name of the release the chart is rendered for. Defaults to the name of the
+	// MicroApplication.
+	ReleaseName string `json:"releaseName,omitempty"`
+	// ValueFiles are paths of values files in the Git repository, relative to its root. Later files take
+	// precedence over earlier ones. They can't be used with charts from a chart repository.
+	ValueFiles []string `json:"valueFiles,omitempty"`
+	// ValuesFrom are ConfigMaps and Secrets in the namespace of the MicroApplication holding values. They take
+	// precedence over ValueFiles, later ones over earlier ones. The creator of the MicroApplication must be
+	// allowed to get them.
+	ValuesFrom []HelmValuesReference `json:"valuesFrom,omitempty"`
+	// Values are values in YAML, which take precedence over ValueFiles and ValuesFrom.
+	Values string `json:"values,omitempty"`
+}
+
+// HelmValuesReference points to values held by a ConfigMap or a Secret
+type HelmValuesReference struct {
+	// Kind is ConfigMap or Secret.
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	Kind string `json:"kind"`
+	// Name is the name of the ConfigMap or Secret.
+	Name string `json:"name"`
+	// Key is the key holding the values in YAML. Defaults to values.yaml.
+	Key string `json:"key,omitempty"`
+}
+
+// SyncPolicy controls how the application is synced
+type SyncPolicy struct {
+	// Prune deletes resources which were applied by a previous sync but are no longer rendered from the source.
+	Prune bool `json:"prune,omitempty"`
+	// Interval is how often the source is polled for changes, e.g. "30s" or "1h".
+	// Defaults to the --sync-interval of the controller.
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// SelfHeal syncs the application as soon as one of its resources is changed or deleted in the cluster,
+	// rather than at the next interval. Repeated self-heals are backed off, up to 5 minutes apart.
+	SelfHeal bool `json:"selfHeal,omitempty"`
+	// Mode is apply (the default), which applies the resources to the cluster, or preview, which only
+	// records in status.preview what applying them would change.
+	Mode SyncMode `json:"mode,omitempty"`
+}
+
+// SyncMode selects whether resources are applied or only previewed.
+// +kubebuilder:validation:Enum=apply;preview
+type SyncMode string
+
+const (
+	// SyncModeApply applies the resources to the cluster.
+	SyncModeApply SyncMode = "apply"
+	// SyncModePreview computes what applying the resources would change, without changing anything.
+	SyncModePreview SyncMode = "preview"
+)
+
 // MicroApplicationStatus defines the observed state of MicroApplication
 type MicroApplicationStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
-	Allowed  bool   `json:"allowed"`
+	Allowed bool `json:"allowed"`
+	// LastSync is kept for compatibility, use LastSyncTime instead.
 	LastSync string `json:"lastSync"`
+
+	// ObservedGeneration is the generation of the spec the status was computed for.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastSyncTime is the time resources were last applied to the cluster.
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+	// Conditions describe the state of the last sync, see the Condition* constants.
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Resources is the outcome of applying each resource rendered from the source during the last sync,
+	// at most 100 of them, those which failed first.
+	Resources []ResourceStatus `json:"resources,omitempty"`
+	// ResourcesOmitted is the number of resources left out of Resources.
+	ResourcesOmitted int32 `json:"resourcesOmitted,omitempty"`
+	// Inventory lists every resource applied by the controller which hasn't been pruned yet.
+	Inventory []ResourceRef `json:"inventory,omitempty"`
+
+	// Sync describes what was last synced.
+	Sync *SyncStatus `json:"sync,omitempty"`
+	// History lists the most recent changes in the synced revision, creator or result, oldest first.
+	History []SyncHistory `json:"history,omitempty"`
+
+	// SyncStatus tells whether the live resources match the source as of the last sync.
+	SyncStatus ComparisonResult `json:"syncStatus,omitempty"`
+	// Drifted lists the resources which differed from the source when the last sync started. In apply mode
+	// they were applied again, in preview mode they are left as they are. At most 100 of them are listed.
+	Drifted []ResourceChange `json:"drifted,omitempty"`
+	// DriftedOmitted is the number of drifted resources left out of Drifted.
+	DriftedOmitted int32 `json:"driftedOmitted,omitempty"`
+
+	// Preview describes what syncing the source would change. It is only set in preview mode.
+	Preview *Preview `json:"preview,omitempty"`
+}
+
+// ComparisonResult is the result of comparing the live resources with the source.
+type ComparisonResult string
+
+const (
+	// ComparisonSynced means every live resource matches the source.
+	ComparisonSynced ComparisonResult = "Synced"
+	// ComparisonOutOfSync means at least one live resource is missing, differs from the source or is no longer in it.
+	ComparisonOutOfSync ComparisonResult = "OutOfSync"
+	// ComparisonUnknown means the live resources couldn't be compared with the source.
+	ComparisonUnknown ComparisonResult = "Unknown"
+)
+
+// Preview describes what syncing a revision would change, as computed by a server-side dry-run.
+type Preview struct {
+	// Revision is the commit, or the chart version, the preview was computed for.
+	Revision string `json:"revision"`
+	// Time is the time the preview was computed.
+	Time metav1.Time `json:"time"`
+	// Create is the number of resources which would be created.
+	Create int32 `json:"create"`
+	// Update is the number of resources which would be updated.
+	Update int32 `json:"update"`
+	// Delete is the number of resources which would be pruned.
+	Delete int32 `json:"delete"`
+	// Unchanged is the number of resources which are already up to date.
+	Unchanged int32 `json:"unchanged"`
+	// Failed is the number of resources the dry-run rejected.
+	Failed int32 `json:"failed"`
+	// Changes lists every resource which would be created, updated or pruned, and those the
+	// dry-run rejected.
+	Changes []ResourceChange `json:"changes,omitempty"`
 }
 
+// ChangeAction is what syncing would do to a resource.
+type ChangeAction string
+
+const (
+	// ChangeCreate means the resource doesn't exist yet.
+	ChangeCreate ChangeAction = "Create"
+	// ChangeUpdate means the live resource differs from the source.
+	ChangeUpdate ChangeAction = "Update"
+	// ChangeDelete means the resource is no longer in the source and would be pruned.
+	ChangeDelete ChangeAction = "Delete"
+	// ChangeFailed means the dry-run was rejected, see the message.
+	ChangeFailed ChangeAction = "Failed"
+)
+
+// ResourceChange describes what syncing would do to a single resource.
+type ResourceChange struct {
+	ResourceRef `json:",inline"`
+
+	// Action is what syncing would do to the resource.
+	Action ChangeAction `json:"action"`
+	// Fields lists the fields an update would change, at most 20 of them.
+	Fields []FieldChange `json:"fields,omitempty"`
+	// Message holds the error returned by the dry-run, if any.
+	Message string `json:"message,omitempty"`
+}
+
+// FieldChange describes the change of a single field. Values are JSON encoded and truncated,
+// the values of Secrets are never shown.
+type FieldChange struct {
+	// Path is the path of the field, e.g. .spec.template.spec.containers[0].image.
+	Path string `json:"path"`
+	// Old is the live value of the field, empty when the field would be added.
+	Old string `json:"old,omitempty"`
+	// New is the value the field would have, empty when the field would be removed.
+	New string `json:"new,omitempty"`
+}
+
+// SyncStatus describes what was last synced
+type SyncStatus struct {
+	// Revision is the commit, or the chart version, the resources were last synced from.
+	Revision string `json:"revision,omitempty"`
+	// TargetRevision is the spec.targetRevision the revision was resolved from.
+	TargetRevision string `json:"targetRevision,omitempty"`
+}
+
+// SyncResult is the overall result of a sync.
+type SyncResult string
+
+const (
+	// SyncSucceeded means every resource was applied and pruned.
+	SyncSucceeded SyncResult = "Succeeded"
+	// SyncFailed means at least one resource couldn't be applied or pruned.
+	SyncFailed SyncResult = "Failed"
+	// SyncPermissionDenied means the creator wasn't allowed to manage the resources, nothing was applied.
+	SyncPermissionDenied SyncResult = "PermissionDenied"
+)
+
+// SyncHistory records a sync which changed the revision, the creator or the result.
+type SyncHistory struct {
+	// Revision is the commit, or the chart version, which was synced.
+	Revision string `json:"revision"`
+	// Time is the time of the first sync with this revision, creator and result.
+	Time metav1.Time `json:"time"`
+	// Result is the result of the sync.
+	Result SyncResult `json:"result"`
+	// Creator is the user the resources were synced on behalf of.
+	Creator string `json:"creator,omitempty"`
+	// Message gives details about a failed sync.
+	Message string `json:"message,omitempty"`
+}
+
+// Condition types reported in MicroApplicationStatus.Conditions.
+const (
+	// ConditionSourceReady tells whether the manifests could be fetched and parsed.
+	ConditionSourceReady = "SourceReady"
+	// ConditionPermissionsGranted tells whether the creator is allowed to manage every resource.
+	ConditionPermissionsGranted = "PermissionsGranted"
+	// ConditionSynced tells whether every resource was applied (and pruned) successfully.
+	ConditionSynced = "Synced"
+	// ConditionHealthy tells whether every applied resource reports itself as healthy.
+	ConditionHealthy = "Healthy"
+)
+
+// ResourceSyncStatus is the result of applying a single resource.
+type ResourceSyncStatus string
+
+const (
+	// ResourceSynced means the resource was applied successfully.
+	ResourceSynced ResourceSyncStatus = "Synced"
+	// ResourceSyncFailed means the API server rejected the resource.
+	ResourceSyncFailed ResourceSyncStatus = "SyncFailed"
+	// ResourcePermissionDenied means the creator, impersonated by the controller, isn't allowed to apply the resource.
+	ResourcePermissionDenied ResourceSyncStatus = "PermissionDenied"
+	// ResourcePruned means the resource is no longer in the source and was deleted.
+	ResourcePruned ResourceSyncStatus = "Pruned"
+	// ResourcePruneFailed means the resource is no longer in the source but couldn't be deleted.
+	ResourcePruneFailed ResourceSyncStatus = "PruneFailed"
+)
+
+// ResourceRef identifies a resource managed by a MicroApplication.
+type ResourceRef struct {
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// ResourceStatus holds the outcome of applying a single resource.
+type ResourceStatus struct {
+	ResourceRef `json:",inline"`
+
+	// Status is the result of the last apply of this resource.
+	Status ResourceSyncStatus `json:"status"`
+	// Message holds the error returned by the API server, if any.
+	Message string `json:"message,omitempty"`
+	// Health is the health of the resource as observed right after it was applied.
+	Health ResourceHealth `json:"health,omitempty"`
+}
+
+// ResourceHealth is the health of a resource as reported by its status.
+type ResourceHealth string
+
+const (
+	// ResourceHealthy means the resource reached its desired state.
+	ResourceHealthy ResourceHealth = "Healthy"
+	// ResourceProgressing means the resource is still working towards its desired state.
+	ResourceProgressing ResourceHealth = "Progressing"
+	// ResourceDegraded means the resource failed to reach its desired state.
+	ResourceDegraded ResourceHealth = "Degraded"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Sync Status",type=string,JSONPath=`.status.syncStatus`
+//+kubebuilder:printcolumn:name="Synced",type=string,JSONPath=`.status.conditions[?(@.type=="Synced")].status`
+//+kubebuilder:printcolumn:name="Healthy",type=string,JSONPath=`.status.conditions[?(@.type=="Healthy")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // MicroApplication is the Schema for the microapplications API
 type MicroApplication struct {
@@ -0,0 +1,369 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+)
+
+// CreatorAnnotation holds the name of the user who created a MicroApplication. It is set by the mutating
+// webhook along with spec.creator and can't be changed afterwards.
+const CreatorAnnotation = "generated-creator"
+
+// log is for logging in this package.
+var microapplicationlog = logf.Log.WithName("microapplication-resource")
+
+const (
+	// MutatingWebhookPath is the path the mutating webhook is served on.
+	MutatingWebhookPath = "/mutate-argoproj-io-v1alpha1-microapplication"
+	// ValidatingWebhookPath is the path the validating webhook is served on.
+	ValidatingWebhookPath = "/validate-argoproj-io-v1alpha1-microapplication"
+)
+
+// maxReleaseNameLength is the length of the longest release name Helm accepts.
+const maxReleaseNameLength = 53
+
+// DefaultAllowedURLSchemes are the schemes of the repository URLs accepted by default. Local paths and file
+// URLs are never accepted, since they would give access to the filesystem of the controller.
+var DefaultAllowedURLSchemes = []string{"https", "ssh"}
+
+// SetupWebhookWithManager registers the webhooks of MicroApplication with the webhook server of mgr. Only
+// repository URLs with one of allowedSchemes are admitted; SCP-like URLs, e.g. git@github.com:org/repo.git,
+// count as ssh.
+func (r *MicroApplication) SetupWebhookWithManager(mgr ctrl.Manager, allowedSchemes []string) error {
+	schemes := make([]string, 0, len(allowedSchemes))
+	for _, scheme := range allowedSchemes {
+		// Schemes are case-insensitive, and compared once lowercased.
+		scheme = strings.ToLower(scheme)
+		if scheme == "file" {
+			return fmt.Errorf("repository URLs with the %s scheme can't be allowed", scheme)
+		}
+		schemes = append(schemes, scheme)
+	}
+	server := mgr.GetWebhookServer()
+	server.Register(MutatingWebhookPath, &webhook.Admission{Handler: &creatorStamper{}})
+	server.Register(ValidatingWebhookPath, &webhook.Admission{Handler: &specValidator{allowedSchemes: schemes}})
+	return nil
+}
+
+//+kubebuilder:webhook:path=/mutate-argoproj-io-v1alpha1-microapplication,mutating=true,failurePolicy=fail,sideEffects=None,groups=argoproj.io,resources=microapplications,verbs=create;update,versions=v1alpha1,name=mmicroapplication.kb.io,admissionReviewVersions={v1,v1beta1}
+
+// creatorStamper records the user creating a MicroApplication in its spec.creator and CreatorAnnotation,
+// and rejects any attempt to change the annotation later on. Updates which leave either out, e.g. kubectl
+// replace, keep the recorded ones.
+type creatorStamper struct {
+	decoder *admission.Decoder
+}
+
+var _ admission.Handler = &creatorStamper{}
+
+// InjectDecoder implements admission.DecoderInjector.
+func (s *creatorStamper) InjectDecoder(d *admission.Decoder) error {
+	s.decoder = d
+	return nil
+}
+
+// Handle implements admission.Handler.
+func (s *creatorStamper) Handle(ctx context.Context, req admission.Request) admission.Response {
+	app := &MicroApplication{}
+	if err := s.decoder.Decode(req, app); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	switch req.Operation {
+	case admissionv1.Create:
+		// Whatever the user set is overwritten.
+		if app.Annotations == nil {
+			app.Annotations = map[string]string{}
+		}
+		app.Annotations[CreatorAnnotation] = req.UserInfo.Username
+		creator := req.UserInfo
+		app.Spec.Creator = &creator
+		microapplicationlog.Info("stamping creator", "namespace", req.Namespace, "name", app.Name, "creator", req.UserInfo.Username)
+
+		marshaled, err := json.Marshal(app)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+
+	case admissionv1.Update:
+		old := &MicroApplication{}
+		if err := s.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		oldCreator, oldSet := old.Annotations[CreatorAnnotation]
+		newCreator, newSet := app.Annotations[CreatorAnnotation]
+		restored := false
+		if oldSet && !newSet {
+			if app.Annotations == nil {
+				app.Annotations = map[string]string{}
+			}
+			app.Annotations[CreatorAnnotation] = oldCreator
+			newCreator, newSet = oldCreator, true
+			restored = true
+		}
+		if oldSet != newSet || oldCreator != newCreator {
+			return admission.Denied(fmt.Sprintf("the %s annotation is set when the MicroApplication is created and can't be changed", CreatorAnnotation))
+		}
+		// Changes of spec.creator are left to the validating webhook.
+		if old.Spec.Creator != nil && app.Spec.Creator == nil {
+			app.Spec.Creator = old.Spec.Creator
+			restored = true
+		}
+		if restored {
+			marshaled, err := json.Marshal(app)
+			if err != nil {
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
+			return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+		}
+	}
+	return admission.Allowed("")
+}
+
+//+kubebuilder:webhook:path=/validate-argoproj-io-v1alpha1-microapplication,mutating=false,failurePolicy=fail,sideEffects=None,groups=argoproj.io,resources=microapplications,verbs=create;update,versions=v1alpha1,name=vmicroapplication.kb.io,admissionReviewVersions={v1,v1beta1}
+
+// specValidator rejects MicroApplications which can't be synced, or which would reach outside of their
+// repository, and updates of the identity of their creator.
+type specValidator struct {
+	decoder        *admission.Decoder
+	allowedSchemes []string
+}
+
+var _ admission.Handler = &specValidator{}
+
+// InjectDecoder implements admission.DecoderInjector.
+func (v *specValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle implements admission.Handler.
+func (v *specValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	app := &MicroApplication{}
+	if err := v.decoder.Decode(req, app); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	var errs field.ErrorList
+	switch req.Operation {
+	case admissionv1.Create:
+		errs = v.validateSpec(&app.Spec, field.NewPath("spec"))
+
+	case admissionv1.Update:
+		old := &MicroApplication{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		errs = validateIdentity(old, app)
+		// Applications admitted before the webhook was installed, or before the allowed schemes changed, must
+		// still be updatable, e.g. for their finalizer to be released.
+		if !reflect.DeepEqual(old.Spec, app.Spec) {
+			errs = append(errs, v.validateSpec(&app.Spec, field.NewPath("spec"))...)
+		}
+	}
+
+	if len(errs) > 0 {
+		err := apierrors.NewInvalid(GroupVersion.WithKind("MicroApplication").GroupKind(), app.Name, errs)
+		return admission.Response{AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &err.ErrStatus,
+		}}
+	}
+	return admission.Allowed("")
+}
+
+func (v *specValidator) validateSpec(spec *MicroApplicationSpec, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	errs = append(errs, v.validateRepoURL(spec.RepoURL, fldPath.Child("repoURL"))...)
+	errs = append(errs, validatePath(spec.Path, fldPath.Child("path"))...)
+	if spec.Helm != nil && spec.Helm.Chart != "" {
+		errs = append(errs, validateChartSource(spec, fldPath)...)
+	} else if spec.TargetRevision != "" && !isValidRefName(spec.TargetRevision) {
+		errs = append(errs, field.Invalid(fldPath.Child("targetRevision"), spec.TargetRevision, "must be a branch, a tag or a commit SHA"))
+	}
+	if spec.Helm != nil {
+		errs = append(errs, validateHelm(spec, fldPath)...)
+	}
+	if spec.Destination != nil && spec.Destination.Namespace != "" {
+		for _, msg := range validation.IsDNS1123Label(spec.Destination.Namespace) {
+			errs = append(errs, field.Invalid(fldPath.Child("destination", "namespace"), spec.Destination.Namespace, msg))
+		}
+	}
+	return errs
+}
+
+func (v *specValidator) validateRepoURL(repoURL string, fldPath *field.Path) field.ErrorList {
+	if repoURL == "" {
+		return field.ErrorList{field.Required(fldPath, "")}
+	}
+	// Remote helpers, e.g. ext::<command>, and options would otherwise pass for
+	// SCP-like URLs.
+	if strings.Contains(repoURL, "::") || strings.HasPrefix(repoURL, "-") || strings.IndexFunc(repoURL, isSpaceOrControl) >= 0 {
+		return field.ErrorList{field.Invalid(fldPath, repoURL, "must be a URL or an SCP-like address")}
+	}
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, repoURL, err.Error())}
+	}
+	if endpoint.Protocol == "file" {
+		return field.ErrorList{field.Invalid(fldPath, repoURL, "local repositories are not supported")}
+	}
+	if !contains(v.allowedSchemes, endpoint.Protocol) {
+		return field.ErrorList{field.NotSupported(fldPath, endpoint.Protocol, v.allowedSchemes)}
+	}
+	if endpoint.Host == "" || strings.HasPrefix(endpoint.Host, "-") {
+		return field.ErrorList{field.Invalid(fldPath, repoURL, "must have a host")}
+	}
+	return nil
+}
+
+// validatePath rejects paths which could point outside of the repository.
+func validatePath(p string, fldPath *field.Path) field.ErrorList {
+	if path.IsAbs(p) || strings.HasPrefix(p, "\\") {
+		return field.ErrorList{field.Invalid(fldPath, p, "must be relative to the root of the repository")}
+	}
+	for _, element := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if element == ".." {
+			return field.ErrorList{field.Invalid(fldPath, p, "must not contain '..'")}
+		}
+	}
+	return nil
+}
+
+// validateChartSource validates the fields of spec which are interpreted differently when the chart is fetched
+// from a chart repository.
+func validateChartSource(spec *MicroApplicationSpec, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if u, err := url.Parse(spec.RepoURL); err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, field.Invalid(fldPath.Child("repoURL"), spec.RepoURL, "must be an http(s) URL for charts from a chart repository"))
+	}
+	if spec.Path != "" {
+		errs = append(errs, field.Forbidden(fldPath.Child("path"), "may not be set for charts from a chart repository"))
+	}
+	if spec.TargetRevision != "" {
+		if _, err := semver.NewConstraint(spec.TargetRevision); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("targetRevision"), spec.TargetRevision, "must be a semver version or range"))
+		}
+	}
+	if len(spec.Helm.ValueFiles) > 0 {
+		errs = append(errs, field.Forbidden(fldPath.Child("helm", "valueFiles"), "may not be set for charts from a chart repository"))
+	}
+	return errs
+}
+
+// validateHelm validates spec.helm.
+func validateHelm(spec *MicroApplicationSpec, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	helmPath := fldPath.Child("helm")
+	if spec.Kustomize != nil {
+		errs = append(errs, field.Forbidden(helmPath, "may not be set along with kustomize"))
+	}
+	if name := spec.Helm.ReleaseName; name != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(name) {
+			errs = append(errs, field.Invalid(helmPath.Child("releaseName"), name, msg))
+		}
+		// Helm's own limit, names of resources are often derived from it.
+		if len(name) > maxReleaseNameLength {
+			errs = append(errs, field.TooLong(helmPath.Child("releaseName"), name, maxReleaseNameLength))
+		}
+	}
+	for i, file := range spec.Helm.ValueFiles {
+		errs = append(errs, validatePath(file, helmPath.Child("valueFiles").Index(i))...)
+	}
+	for i, ref := range spec.Helm.ValuesFrom {
+		for _, msg := range validation.IsDNS1123Subdomain(ref.Name) {
+			errs = append(errs, field.Invalid(helmPath.Child("valuesFrom").Index(i).Child("name"), ref.Name, msg))
+		}
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(spec.Helm.Values), &values); err != nil {
+		errs = append(errs, field.Invalid(helmPath.Child("values"), spec.Helm.Values, fmt.Sprintf("must be a YAML map: %v", err)))
+	}
+	return errs
+}
+
+// isValidRefName tells whether name is a valid Git reference name, following the rules of
+// git check-ref-format --allow-onelevel. Commit SHAs are valid reference names too.
+func isValidRefName(name string) bool {
+	if name == "@" || strings.HasPrefix(name, "-") || strings.HasPrefix(name, "/") ||
+		strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") ||
+		strings.Contains(name, "..") || strings.Contains(name, "//") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) {
+			return false
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// validateIdentity rejects changes of the fields identifying the creator of an application, which the
+// controller acts on behalf of. Fields left out of an update have been restored by the mutating webhook by
+// then, so that only setting them to another value is rejected.
+func validateIdentity(old, app *MicroApplication) field.ErrorList {
+	var errs field.ErrorList
+	oldCreator, oldSet := old.Annotations[CreatorAnnotation]
+	creator, set := app.Annotations[CreatorAnnotation]
+	if oldSet != set || oldCreator != creator {
+		errs = append(errs, field.Forbidden(field.NewPath("metadata", "annotations").Key(CreatorAnnotation), "is immutable"))
+	}
+	if !reflect.DeepEqual(old.Spec.Creator, app.Spec.Creator) {
+		errs = append(errs, field.Forbidden(field.NewPath("spec", "creator"), "is immutable"))
+	}
+	return errs
+}
+
+func isSpaceOrControl(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
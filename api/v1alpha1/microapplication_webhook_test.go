@@ -0,0 +1,415 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestValidateRepoURL(t *testing.T) {
+	tests := []struct {
+		repoURL string
+		valid   bool
+	}{
+		{repoURL: "https://github.com/org/repo", valid: true},
+		{repoURL: "https://github.com/org/repo.git", valid: true},
+		{repoURL: "ssh://git@github.com/org/repo.git", valid: true},
+		{repoURL: "git@github.com:org/repo.git", valid: true},
+		{repoURL: "HTTPS://github.com/org/repo", valid: true},
+		{repoURL: "Ssh://git@github.com/org/repo.git", valid: true},
+		{repoURL: ""},
+		{repoURL: "http://github.com/org/repo"},
+		{repoURL: "HTTP://github.com/org/repo"},
+		{repoURL: "git://github.com/org/repo"},
+		{repoURL: "file:///etc/kubernetes"},
+		{repoURL: "FILE:///etc/kubernetes"},
+		{repoURL: "file://localhost/tmp/other-namespace/other-app"},
+		{repoURL: "/tmp/other-namespace/other-app"},
+		{repoURL: "../other-app"},
+		{repoURL: "ext::sh -c touch% /tmp/pwned"},
+		{repoURL: "ext::ssh -oProxyCommand=x host/repo"},
+		{repoURL: "fd::17/repo"},
+		{repoURL: "-oProxyCommand=x:org/repo"},
+		{repoURL: "ssh://-oProxyCommand=x/org/repo"},
+		{repoURL: "https:///org/repo"},
+		{repoURL: "https://github.com/org/repo\n"},
+		{repoURL: "https://github.com/org/\x00repo"},
+	}
+	v := &specValidator{allowedSchemes: DefaultAllowedURLSchemes}
+	for _, tt := range tests {
+		errs := v.validateRepoURL(tt.repoURL, field.NewPath("spec", "repoURL"))
+		if tt.valid && len(errs) > 0 {
+			t.Errorf("%q: unexpected errors: %v", tt.repoURL, errs)
+		}
+		if !tt.valid && len(errs) == 0 {
+			t.Errorf("%q: accepted", tt.repoURL)
+		}
+	}
+}
+
+func TestValidatePath(t *testing.T) {
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{path: "", valid: true},
+		{path: ".", valid: true},
+		{path: "deploy", valid: true},
+		{path: "deploy/overlays/prod", valid: true},
+		{path: "deploy/..data", valid: true},
+		{path: "...", valid: true},
+		{path: ".."},
+		{path: "../other-app"},
+		{path: "deploy/../../other-app"},
+		{path: "deploy/.."},
+		{path: "deploy\\..\\..\\other-app"},
+		{path: "/"},
+		{path: "/etc/kubernetes"},
+		{path: "\\etc"},
+	}
+	for _, tt := range tests {
+		errs := validatePath(tt.path, field.NewPath("spec", "path"))
+		if tt.valid && len(errs) > 0 {
+			t.Errorf("%q: unexpected errors: %v", tt.path, errs)
+		}
+		if !tt.valid && len(errs) == 0 {
+			t.Errorf("%q: accepted", tt.path)
+		}
+	}
+}
+
+func TestValidateHelm(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  MicroApplicationSpec
+		valid bool
+	}{
+		{
+			name:  "chart in Git",
+			spec:  MicroApplicationSpec{RepoURL: "https://github.com/org/repo", Path: "charts/app", TargetRevision: "main", Helm: &HelmOptions{ValueFiles: []string{"envs/prod.yaml"}}},
+			valid: true,
+		},
+		{
+			name:  "chart repository",
+			spec:  MicroApplicationSpec{RepoURL: "https://charts.example.com", TargetRevision: "~1.2", Helm: &HelmOptions{Chart: "app", ReleaseName: "app-prod"}},
+			valid: true,
+		},
+		{
+			name:  "values",
+			spec:  MicroApplicationSpec{RepoURL: "https://charts.example.com", Helm: &HelmOptions{Chart: "app", Values: "replicas: 2\n", ValuesFrom: []HelmValuesReference{{Kind: "Secret", Name: "app-values"}}}},
+			valid: true,
+		},
+		{
+			name: "along with kustomize",
+			spec: MicroApplicationSpec{RepoURL: "https://github.com/org/repo", Helm: &HelmOptions{}, Kustomize: &KustomizeOptions{NamePrefix: "prod-"}},
+		},
+		{
+			name: "value file outside of the repository",
+			spec: MicroApplicationSpec{RepoURL: "https://github.com/org/repo", Helm: &HelmOptions{ValueFiles: []string{"../other/values.yaml"}}},
+		},
+		{
+			name: "value files with a chart repository",
+			spec: MicroApplicationSpec{RepoURL: "https://charts.example.com", Helm: &HelmOptions{Chart: "app", ValueFiles: []string{"values.yaml"}}},
+		},
+		{
+			name: "path with a chart repository",
+			spec: MicroApplicationSpec{RepoURL: "https://charts.example.com", Path: "app", Helm: &HelmOptions{Chart: "app"}},
+		},
+		{
+			name: "ssh chart repository",
+			spec: MicroApplicationSpec{RepoURL: "ssh://git@github.com/org/repo.git", Helm: &HelmOptions{Chart: "app"}},
+		},
+		{
+			name: "branch as the chart version",
+			spec: MicroApplicationSpec{RepoURL: "https://charts.example.com", TargetRevision: "main", Helm: &HelmOptions{Chart: "app"}},
+		},
+		{
+			name: "invalid release name",
+			spec: MicroApplicationSpec{RepoURL: "https://github.com/org/repo", Helm: &HelmOptions{ReleaseName: "App"}},
+		},
+		{
+			name: "long release name",
+			spec: MicroApplicationSpec{RepoURL: "https://github.com/org/repo", Helm: &HelmOptions{ReleaseName: strings.Repeat("a", maxReleaseNameLength+1)}},
+		},
+		{
+			name: "invalid values reference",
+			spec: MicroApplicationSpec{RepoURL: "https://github.com/org/repo", Helm: &HelmOptions{ValuesFrom: []HelmValuesReference{{Kind: "ConfigMap", Name: "../values"}}}},
+		},
+		{
+			name: "values which aren't a map",
+			spec: MicroApplicationSpec{RepoURL: "https://github.com/org/repo", Helm: &HelmOptions{Values: "- replicas"}},
+		},
+	}
+	v := &specValidator{allowedSchemes: DefaultAllowedURLSchemes}
+	for _, tt := range tests {
+		errs := v.validateSpec(&tt.spec, field.NewPath("spec"))
+		if tt.valid && len(errs) > 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.name, errs)
+		}
+		if !tt.valid && len(errs) == 0 {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestIsValidRefName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "main", valid: true},
+		{name: "feature/login", valid: true},
+		{name: "refs/heads/main", valid: true},
+		{name: "v1.2.3", valid: true},
+		{name: "HEAD", valid: true},
+		{name: "0123456789abcdef0123456789abcdef01234567", valid: true},
+		{name: "refs/../config"},
+		{name: "refs/heads/../../config"},
+		{name: "main..other"},
+		{name: "main@{1}"},
+		{name: "@{-1}"},
+		{name: "@"},
+		{name: "/main"},
+		{name: "main/"},
+		{name: "main."},
+		{name: "feature//login"},
+		{name: ".hidden"},
+		{name: "feature/.hidden"},
+		{name: "main.lock"},
+		{name: "-main"},
+		{name: "--upload-pack=touch"},
+		{name: "main\x00"},
+		{name: "main\n"},
+		{name: "main\x7f"},
+		{name: "main branch"},
+		{name: "main~1"},
+		{name: "main^"},
+		{name: "main:other"},
+		{name: "main?"},
+		{name: "main*"},
+		{name: "main[0]"},
+		{name: "main\\other"},
+	}
+	for _, tt := range tests {
+		if valid := isValidRefName(tt.name); valid != tt.valid {
+			t.Errorf("isValidRefName(%q) = %v, want %v", tt.name, valid, tt.valid)
+		}
+	}
+}
+
+// stamp runs the creator stamper on app, as created or updated from old by user, and returns its response
+// along with app as patched by it.
+func stamp(t *testing.T, user authenticationv1.UserInfo, old, app *MicroApplication) (admission.Response, *MicroApplication) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &creatorStamper{decoder: decoder}
+
+	marshal := func(app *MicroApplication) []byte {
+		app = app.DeepCopy()
+		app.TypeMeta = metav1.TypeMeta{APIVersion: GroupVersion.String(), Kind: "MicroApplication"}
+		raw, err := json.Marshal(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		UserInfo:  user,
+		Object:    runtime.RawExtension{Raw: marshal(app)},
+	}}
+	if old != nil {
+		req.Operation = admissionv1.Update
+		req.OldObject = runtime.RawExtension{Raw: marshal(old)}
+	}
+
+	resp := s.Handle(context.Background(), req)
+	patch, err := json.Marshal(resp.Patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := decoded.Apply(req.Object.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &MicroApplication{}
+	if err := json.Unmarshal(patched, result); err != nil {
+		t.Fatal(err)
+	}
+	return resp, result
+}
+
+func TestCreatorStamperUpdate(t *testing.T) {
+	alice := authenticationv1.UserInfo{Username: "alice", Groups: []string{"team-a"}}
+	bob := authenticationv1.UserInfo{Username: "bob"}
+	newApp := func(annotation *string, creator *authenticationv1.UserInfo) *MicroApplication {
+		app := &MicroApplication{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"}}
+		app.Spec.RepoURL = "https://github.com/org/repo"
+		if annotation != nil {
+			app.Annotations = map[string]string{CreatorAnnotation: *annotation}
+		}
+		app.Spec.Creator = creator
+		return app
+	}
+	name := func(s string) *string { return &s }
+
+	tests := []struct {
+		name    string
+		old     *MicroApplication
+		app     *MicroApplication
+		allowed bool
+		// want is the annotation and creator the application is left with.
+		want *MicroApplication
+		// invalid tells that the validating webhook rejects the result.
+		invalid bool
+	}{
+		{
+			name:    "unchanged",
+			old:     newApp(name("alice"), &alice),
+			app:     newApp(name("alice"), &alice),
+			allowed: true,
+			want:    newApp(name("alice"), &alice),
+		},
+		{
+			name:    "left out",
+			old:     newApp(name("alice"), &alice),
+			app:     newApp(nil, nil),
+			allowed: true,
+			want:    newApp(name("alice"), &alice),
+		},
+		{
+			name:    "annotation left out",
+			old:     newApp(name("alice"), &alice),
+			app:     newApp(nil, &alice),
+			allowed: true,
+			want:    newApp(name("alice"), &alice),
+		},
+		{
+			name:    "creator left out",
+			old:     newApp(name("alice"), &alice),
+			app:     newApp(name("alice"), nil),
+			allowed: true,
+			want:    newApp(name("alice"), &alice),
+		},
+		{
+			name: "annotation changed",
+			old:  newApp(name("alice"), &alice),
+			app:  newApp(name("bob"), &alice),
+		},
+		{
+			name: "annotation set",
+			old:  newApp(nil, nil),
+			app:  newApp(name("bob"), nil),
+		},
+		{
+			// Changes of the creator are rejected by the validating webhook.
+			name:    "creator changed",
+			old:     newApp(name("alice"), &alice),
+			app:     newApp(name("alice"), &bob),
+			allowed: true,
+			want:    newApp(name("alice"), &bob),
+			invalid: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, app := stamp(t, bob, tt.old, tt.app)
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v: %v", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if !tt.allowed {
+				return
+			}
+			if !reflect.DeepEqual(app.Annotations, tt.want.Annotations) {
+				t.Errorf("annotations = %v, want %v", app.Annotations, tt.want.Annotations)
+			}
+			if !reflect.DeepEqual(app.Spec.Creator, tt.want.Spec.Creator) {
+				t.Errorf("creator = %+v, want %+v", app.Spec.Creator, tt.want.Spec.Creator)
+			}
+			if errs := validateIdentity(tt.old, app); (len(errs) > 0) != tt.invalid {
+				t.Errorf("validateIdentity() = %v, want invalid %v", errs, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestCreatorStamperCreate(t *testing.T) {
+	alice := authenticationv1.UserInfo{
+		Username: "alice",
+		UID:      "42",
+		Groups:   []string{"team-a", "system:authenticated"},
+		Extra:    map[string]authenticationv1.ExtraValue{"scopes": {"user:full"}},
+	}
+	forged := authenticationv1.UserInfo{Username: "kube:admin", Groups: []string{"system:masters"}}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		creator     *authenticationv1.UserInfo
+	}{
+		{name: "unset"},
+		{name: "forged annotation", annotations: map[string]string{CreatorAnnotation: "kube:admin", "team": "a"}},
+		{name: "forged creator", creator: &forged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &MicroApplication{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app", Annotations: tt.annotations}}
+			app.Spec.RepoURL = "https://github.com/org/repo"
+			app.Spec.Creator = tt.creator
+
+			resp, app := stamp(t, alice, nil, app)
+			if !resp.Allowed {
+				t.Fatalf("denied: %v", resp.Result)
+			}
+			if got := app.Annotations[CreatorAnnotation]; got != "alice" {
+				t.Errorf("%s = %q, want alice", CreatorAnnotation, got)
+			}
+			if !reflect.DeepEqual(app.Spec.Creator, &alice) {
+				t.Errorf("creator = %+v, want %+v", app.Spec.Creator, alice)
+			}
+			// Other annotations are left alone.
+			for key, value := range tt.annotations {
+				if key != CreatorAnnotation && app.Annotations[key] != value {
+					t.Errorf("annotation %s = %q, want %q", key, app.Annotations[key], value)
+				}
+			}
+		})
+	}
+}
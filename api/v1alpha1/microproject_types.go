@@ -0,0 +1,85 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MicroProjectSpec defines what the MicroApplications bound to a project may do, on top of the permissions of
+// their creator. Patterns are shell globs as understood by path.Match, e.g. "https://github.com/org/*" or
+// "team-a-*".
+type MicroProjectSpec struct {
+	// Namespaces are patterns of the namespaces bound to the project: every MicroApplication in a matching
+	// namespace is restricted by the project. A namespace may be bound to a single project, MicroApplications
+	// in namespaces bound to none are unrestricted.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// SourceRepos are patterns of the repository URLs applications may sync from. Nothing may be synced when
+	// it is empty.
+	SourceRepos []string `json:"sourceRepos,omitempty"`
+	// DestinationNamespaces are patterns of the namespaces namespaced resources may be applied to. Namespaced
+	// resources may only be applied to the namespace of their application when it is empty.
+	DestinationNamespaces []string `json:"destinationNamespaces,omitempty"`
+	// AllowCrossNamespace tells whether namespaced resources may target another namespace than the destination
+	// namespace of their application. Defaults to the --allow-cross-namespace setting of the controller.
+	AllowCrossNamespace *bool `json:"allowCrossNamespace,omitempty"`
+
+	// ClusterResourceAllowList lists the cluster-scoped kinds which may be applied. No cluster-scoped
+	// resource may be applied when it is empty.
+	ClusterResourceAllowList []GroupKindPattern `json:"clusterResourceAllowList,omitempty"`
+	// ClusterResourceDenyList lists the cluster-scoped kinds which may not be applied, even when allowed by
+	// ClusterResourceAllowList.
+	ClusterResourceDenyList []GroupKindPattern `json:"clusterResourceDenyList,omitempty"`
+	// NamespaceResourceAllowList lists the namespaced kinds which may be applied. Every namespaced kind may be
+	// applied when it is empty.
+	NamespaceResourceAllowList []GroupKindPattern `json:"namespaceResourceAllowList,omitempty"`
+	// NamespaceResourceDenyList lists the namespaced kinds which may not be applied, even when allowed by
+	// NamespaceResourceAllowList.
+	NamespaceResourceDenyList []GroupKindPattern `json:"namespaceResourceDenyList,omitempty"`
+}
+
+// GroupKindPattern matches the kinds of resources. Group and Kind are patterns, "*" matches any group or kind.
+type GroupKindPattern struct {
+	// Group is the API group of the kind, empty for the core group.
+	Group string `json:"group"`
+	// Kind is the kind.
+	Kind string `json:"kind"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+
+// MicroProject is the Schema for the microprojects API
+type MicroProject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MicroProjectSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MicroProjectList contains a list of MicroProject
+type MicroProjectList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MicroProject `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MicroProject{}, &MicroProjectList{})
+}
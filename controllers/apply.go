@@ -0,0 +1,96 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// fieldManager is the field manager recorded on every field the controller
+// sets through server-side apply.
+const fieldManager = "micro-application"
+
+// applyResources server-side applies with c every resource which differs from
+// its live state, as told by diffs and diffErrs, see diffResources, and
+// reports the outcome of each one, along with the resources which had
+// drifted. Resources which are already up to date aren't applied again. A
+// failure to apply one resource doesn't prevent the others from being applied;
+// all failures are returned as a single aggregated error.
+func (r *MicroApplicationReconciler) applyResources(ctx context.Context, log logr.Logger, c client.Client, resources []*unstructured.Unstructured, diffs []*resourceDiff, diffErrs []error) ([]argoprojiov1alpha1.ResourceStatus, []argoprojiov1alpha1.ResourceChange, error) {
+	statuses := make([]argoprojiov1alpha1.ResourceStatus, 0, len(resources))
+	var drifted []argoprojiov1alpha1.ResourceChange
+	var errs []error
+
+	for i, resource := range resources {
+		status := argoprojiov1alpha1.ResourceStatus{ResourceRef: resourceRef(resource)}
+
+		// When the diff can't be computed, e.g. because the namespace of the
+		// resource doesn't exist yet, applying is the safe choice.
+		diff := diffs[i]
+		if diff == nil {
+			log.V(1).Info("unable to diff resource, applying it", "kind", status.Kind, "namespace", status.Namespace, "name", status.Name, "error", diffErrs[i].Error())
+		} else if change := diff.change(status.ResourceRef); change == nil {
+			status.Status = argoprojiov1alpha1.ResourceSynced
+			status.Health = assessHealth(diff.live)
+			statuses = append(statuses, status)
+			continue
+		} else {
+			drifted = append(drifted, *change)
+		}
+
+		// Patch overwrites the object with the server's response, keep the
+		// rendered manifest intact for anything that runs after the apply.
+		obj := resource.DeepCopy()
+		err := c.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+		if err != nil {
+			log.Error(err, "unable to apply resource", "kind", status.Kind, "namespace", status.Namespace, "name", status.Name)
+			status.Status = argoprojiov1alpha1.ResourceSyncFailed
+			if apierrors.IsForbidden(err) {
+				status.Status = argoprojiov1alpha1.ResourcePermissionDenied
+			}
+			status.Message = err.Error()
+			errs = append(errs, fmt.Errorf("%s %s/%s: %v", status.Kind, status.Namespace, status.Name, err))
+		} else {
+			log.Info("applied resource", "kind", status.Kind, "namespace", status.Namespace, "name", status.Name)
+			status.Status = argoprojiov1alpha1.ResourceSynced
+			status.Health = assessHealth(obj)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, drifted, utilerrors.NewAggregate(errs)
+}
+
+// resourceRef returns the ResourceRef identifying resource.
+func resourceRef(resource *unstructured.Unstructured) argoprojiov1alpha1.ResourceRef {
+	gvk := resource.GroupVersionKind()
+	return argoprojiov1alpha1.ResourceRef{
+		Group:     gvk.Group,
+		Version:   gvk.Version,
+		Kind:      gvk.Kind,
+		Namespace: resource.GetNamespace(),
+		Name:      resource.GetName(),
+	}
+}
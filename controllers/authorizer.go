@@ -0,0 +1,358 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings;clusterroles;clusterrolebindings,verbs=get;list;watch
+
+// reviewFunc decides whether user has permission p, by asking the API server.
+type reviewFunc func(ctx context.Context, user authenticationv1.UserInfo, p permission) (bool, error)
+
+// decisionKey identifies a decision: the API version of a resource plays no
+// part in authorization, and neither does the name of a resource being
+// created, since it isn't known to the API server at that point.
+type decisionKey struct {
+	// user identifies the whole identity of the user, see identityKey.
+	user        string
+	group       string
+	resource    string
+	subresource string
+	namespace   string
+	name        string
+	verb        string
+}
+
+func newDecisionKey(user authenticationv1.UserInfo, p permission) decisionKey {
+	key := decisionKey{
+		user:        identityKey(user),
+		group:       p.ref.Group,
+		resource:    p.resource,
+		subresource: p.subresource,
+		namespace:   p.ref.Namespace,
+		name:        p.ref.Name,
+		verb:        p.verb,
+	}
+	if key.verb == "create" {
+		key.name = ""
+	}
+	return key
+}
+
+// identityKey returns a string identifying user along with their UID, groups
+// and extra fields, so that decisions made for one set of groups are never
+// reused for another.
+func identityKey(user authenticationv1.UserInfo) string {
+	user.Groups = append([]string(nil), user.Groups...)
+	sort.Strings(user.Groups)
+	// Maps are marshaled with sorted keys.
+	key, _ := json.Marshal(user)
+	return string(key)
+}
+
+// decision is a cached decision.
+type decision struct {
+	allowed bool
+	expires time.Time
+}
+
+// syncDecisions are the decisions made during a single sync, reused within
+// that sync whatever the TTL of the cache.
+type syncDecisions map[decisionKey]bool
+
+type syncDecisionsKey struct{}
+
+// withSyncDecisions returns a context sharing decisions until it is done with,
+// for the duration of a sync.
+func withSyncDecisions(ctx context.Context) context.Context {
+	return context.WithValue(ctx, syncDecisionsKey{}, syncDecisions{})
+}
+
+// permissionEvaluator decides whether creators hold permissions, keeping the
+// load on the API server low for applications with many resources:
+//
+//   - decisions are cached per creator for a TTL, and within a sync,
+//   - permissions are first checked for every resource of a kind in a
+//     namespace, e.g. to create or patch many of them, and only for the
+//     resource's own name when that is denied, so that they share a single
+//     decision,
+//   - an optional local RBAC authorizer grants permissions from the Roles and
+//     bindings in the informer cache, without a request. Since other
+//     authorizers may grant what RBAC doesn't, only the permissions it can't
+//     grant go to the API server.
+type permissionEvaluator struct {
+	review reviewFunc
+	ttl    time.Duration
+	local  *rbacAuthorizer
+
+	mu        sync.Mutex
+	decisions map[string]map[decisionKey]decision
+	nextSweep time.Time
+}
+
+func newPermissionEvaluator(review reviewFunc, ttl time.Duration, local *rbacAuthorizer) *permissionEvaluator {
+	return &permissionEvaluator{
+		review:    review,
+		ttl:       ttl,
+		local:     local,
+		decisions: map[string]map[decisionKey]decision{},
+	}
+}
+
+// allowed tells whether user has permission p.
+func (e *permissionEvaluator) allowed(ctx context.Context, user authenticationv1.UserInfo, p permission) (bool, error) {
+	// Being allowed on every name covers any single one, the name only
+	// matters when that is denied. It plays no part in creations.
+	unnamed := p
+	unnamed.ref.Name = ""
+	allowed, err := e.decide(ctx, user, unnamed)
+	if err != nil || allowed || p.ref.Name == "" || p.verb == "create" {
+		return allowed, err
+	}
+	return e.decide(ctx, user, p)
+}
+
+// decide tells whether user has exactly permission p, going through the
+// decisions of the sync, the cache, the local RBAC authorizer and finally the
+// API server.
+func (e *permissionEvaluator) decide(ctx context.Context, user authenticationv1.UserInfo, p permission) (bool, error) {
+	key := newDecisionKey(user, p)
+	decisions, _ := ctx.Value(syncDecisionsKey{}).(syncDecisions)
+	if allowed, ok := decisions[key]; ok {
+		return allowed, nil
+	}
+	if allowed, ok := e.cached(key); ok {
+		if decisions != nil {
+			decisions[key] = allowed
+		}
+		return allowed, nil
+	}
+
+	allowed := false
+	if e.local != nil {
+		var err error
+		allowed, err = e.local.allows(ctx, user, key)
+		if err != nil {
+			return false, err
+		}
+	}
+	if !allowed {
+		var err error
+		allowed, err = e.review(ctx, user, p)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	e.store(key, allowed)
+	if decisions != nil {
+		decisions[key] = allowed
+	}
+	return allowed, nil
+}
+
+func (e *permissionEvaluator) cached(key decisionKey) (bool, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	d, ok := e.decisions[key.user][key]
+	if !ok || time.Now().After(d.expires) {
+		return false, false
+	}
+	return d.allowed, true
+}
+
+func (e *permissionEvaluator) store(key decisionKey, allowed bool) {
+	if e.ttl <= 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if now.After(e.nextSweep) {
+		e.sweep(now)
+		e.nextSweep = now.Add(e.ttl)
+	}
+	if e.decisions[key.user] == nil {
+		e.decisions[key.user] = map[decisionKey]decision{}
+	}
+	e.decisions[key.user][key] = decision{allowed: allowed, expires: now.Add(e.ttl)}
+}
+
+// sweep drops the expired decisions. e.mu must be held.
+func (e *permissionEvaluator) sweep(now time.Time) {
+	for user, decisions := range e.decisions {
+		for key, d := range decisions {
+			if now.After(d.expires) {
+				delete(decisions, key)
+			}
+		}
+		if len(decisions) == 0 {
+			delete(e.decisions, user)
+		}
+	}
+}
+
+// rbacAuthorizer evaluates RBAC rules locally, from the Roles, ClusterRoles
+// and their bindings read through a cached client. It only ever grants
+// permissions, it can't tell whether another authorizer would.
+type rbacAuthorizer struct {
+	client client.Reader
+}
+
+// allows tells whether a binding grants user the permission identified by key.
+func (a *rbacAuthorizer) allows(ctx context.Context, user authenticationv1.UserInfo, key decisionKey) (bool, error) {
+	clusterBindings := &rbacv1.ClusterRoleBindingList{}
+	if err := a.client.List(ctx, clusterBindings); err != nil {
+		return false, err
+	}
+	for _, binding := range clusterBindings.Items {
+		if !bindsUser(binding.Subjects, "", user) {
+			continue
+		}
+		ok, err := a.roleAllows(ctx, binding.RoleRef, "", key)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+
+	if key.namespace == "" {
+		return false, nil
+	}
+	bindings := &rbacv1.RoleBindingList{}
+	if err := a.client.List(ctx, bindings, client.InNamespace(key.namespace)); err != nil {
+		return false, err
+	}
+	for _, binding := range bindings.Items {
+		if !bindsUser(binding.Subjects, binding.Namespace, user) {
+			continue
+		}
+		ok, err := a.roleAllows(ctx, binding.RoleRef, binding.Namespace, key)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// roleAllows tells whether the role referenced from a binding in namespace
+// (empty for ClusterRoleBindings) has a rule matching key. Missing roles
+// grant nothing.
+func (a *rbacAuthorizer) roleAllows(ctx context.Context, ref rbacv1.RoleRef, namespace string, key decisionKey) (bool, error) {
+	var rules []rbacv1.PolicyRule
+	switch ref.Kind {
+	case "ClusterRole":
+		role := &rbacv1.ClusterRole{}
+		if err := a.client.Get(ctx, client.ObjectKey{Name: ref.Name}, role); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		rules = role.Rules
+	case "Role":
+		role := &rbacv1.Role{}
+		if err := a.client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, role); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		rules = role.Rules
+	default:
+		return false, fmt.Errorf("unknown role kind %q", ref.Kind)
+	}
+
+	for i := range rules {
+		if ruleAllows(&rules[i], key) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// bindsUser tells whether subjects, from a binding in namespace, include
+// user or one of their groups.
+func bindsUser(subjects []rbacv1.Subject, namespace string, user authenticationv1.UserInfo) bool {
+	for _, subject := range subjects {
+		switch subject.Kind {
+		case rbacv1.UserKind:
+			if subject.Name == user.Username {
+				return true
+			}
+		case rbacv1.GroupKind:
+			if contains(user.Groups, subject.Name) {
+				return true
+			}
+		case rbacv1.ServiceAccountKind:
+			ns := subject.Namespace
+			if ns == "" {
+				ns = namespace
+			}
+			// A ServiceAccount without a namespace in a ClusterRoleBinding
+			// binds nobody.
+			if ns != "" && user.Username == fmt.Sprintf("system:serviceaccount:%s:%s", ns, subject.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ruleAllows tells whether rule grants the permission identified by key,
+// following the matching rules of the RBAC authorizer.
+func ruleAllows(rule *rbacv1.PolicyRule, key decisionKey) bool {
+	return matches(rule.Verbs, key.verb) &&
+		matches(rule.APIGroups, key.group) &&
+		resourceMatches(rule.Resources, key.resource, key.subresource) &&
+		(len(rule.ResourceNames) == 0 || (key.name != "" && contains(rule.ResourceNames, key.name)))
+}
+
+// matches tells whether values holds value or the "*" wildcard.
+func matches(values []string, value string) bool {
+	return contains(values, "*") || contains(values, value)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func resourceMatches(ruleResources []string, resource, subresource string) bool {
+	combined := resource
+	if subresource != "" {
+		combined += "/" + subresource
+	}
+	for _, r := range ruleResources {
+		if r == "*" || r == combined {
+			return true
+		}
+		if subresource != "" && r == "*/"+subresource {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,475 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+func TestRuleAllows(t *testing.T) {
+	getPod := decisionKey{resource: "pods", namespace: "team-a", name: "web", verb: "get"}
+	tests := []struct {
+		name  string
+		rule  rbacv1.PolicyRule
+		key   decisionKey
+		allow bool
+	}{
+		{
+			name:  "exact",
+			rule:  rbacv1.PolicyRule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			key:   getPod,
+			allow: true,
+		},
+		{
+			name: "other verb",
+			rule: rbacv1.PolicyRule{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			key:  getPod,
+		},
+		{
+			name: "other group",
+			rule: rbacv1.PolicyRule{Verbs: []string{"get"}, APIGroups: []string{"apps"}, Resources: []string{"pods"}},
+			key:  getPod,
+		},
+		{
+			name:  "wildcards",
+			rule:  rbacv1.PolicyRule{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+			key:   getPod,
+			allow: true,
+		},
+		{
+			name:  "wildcard resources cover subresources",
+			rule:  rbacv1.PolicyRule{Verbs: []string{"patch"}, APIGroups: []string{""}, Resources: []string{"*"}},
+			key:   decisionKey{resource: "pods", subresource: "status", verb: "patch"},
+			allow: true,
+		},
+		{
+			name: "resource doesn't cover its subresources",
+			rule: rbacv1.PolicyRule{Verbs: []string{"patch"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			key:  decisionKey{resource: "pods", subresource: "status", verb: "patch"},
+		},
+		{
+			name:  "subresource",
+			rule:  rbacv1.PolicyRule{Verbs: []string{"patch"}, APIGroups: []string{""}, Resources: []string{"pods/status"}},
+			key:   decisionKey{resource: "pods", subresource: "status", verb: "patch"},
+			allow: true,
+		},
+		{
+			name: "subresource doesn't cover its resource",
+			rule: rbacv1.PolicyRule{Verbs: []string{"patch"}, APIGroups: []string{""}, Resources: []string{"pods/status"}},
+			key:  decisionKey{resource: "pods", verb: "patch"},
+		},
+		{
+			name:  "any status subresource",
+			rule:  rbacv1.PolicyRule{Verbs: []string{"patch"}, APIGroups: []string{"*"}, Resources: []string{"*/status"}},
+			key:   decisionKey{group: "apps", resource: "deployments", subresource: "status", verb: "patch"},
+			allow: true,
+		},
+		{
+			name: "any status subresource doesn't cover resources",
+			rule: rbacv1.PolicyRule{Verbs: []string{"patch"}, APIGroups: []string{"*"}, Resources: []string{"*/status"}},
+			key:  decisionKey{group: "apps", resource: "deployments", verb: "patch"},
+		},
+		{
+			name: "any status subresource doesn't cover other subresources",
+			rule: rbacv1.PolicyRule{Verbs: []string{"patch"}, APIGroups: []string{"*"}, Resources: []string{"*/status"}},
+			key:  decisionKey{group: "apps", resource: "deployments", subresource: "scale", verb: "patch"},
+		},
+		{
+			name:  "resource name",
+			rule:  rbacv1.PolicyRule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}, ResourceNames: []string{"web"}},
+			key:   getPod,
+			allow: true,
+		},
+		{
+			name: "other resource name",
+			rule: rbacv1.PolicyRule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}, ResourceNames: []string{"db"}},
+			key:  getPod,
+		},
+		{
+			name: "resource names never allow create",
+			rule: rbacv1.PolicyRule{Verbs: []string{"create"}, APIGroups: []string{""}, Resources: []string{"pods"}, ResourceNames: []string{"web"}},
+			key: newDecisionKey(authenticationv1.UserInfo{Username: "alice"}, permission{
+				ref:      argoprojiov1alpha1.ResourceRef{Version: "v1", Kind: "Pod", Namespace: "team-a", Name: "web"},
+				resource: "pods",
+				verb:     "create",
+			}),
+		},
+		{
+			name:  "create without resource names",
+			rule:  rbacv1.PolicyRule{Verbs: []string{"create"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+			key:   decisionKey{resource: "pods", namespace: "team-a", verb: "create"},
+			allow: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allow := ruleAllows(&tt.rule, tt.key); allow != tt.allow {
+				t.Errorf("ruleAllows() = %v, want %v", allow, tt.allow)
+			}
+		})
+	}
+}
+
+func TestBindsUser(t *testing.T) {
+	alice := authenticationv1.UserInfo{Username: "alice", Groups: []string{"team-a", "system:authenticated"}}
+	deployer := authenticationv1.UserInfo{Username: "system:serviceaccount:team-a:deployer"}
+	tests := []struct {
+		name      string
+		subject   rbacv1.Subject
+		namespace string
+		user      authenticationv1.UserInfo
+		binds     bool
+	}{
+		{name: "user", subject: rbacv1.Subject{Kind: rbacv1.UserKind, Name: "alice"}, user: alice, binds: true},
+		{name: "other user", subject: rbacv1.Subject{Kind: rbacv1.UserKind, Name: "bob"}, user: alice},
+		{name: "group", subject: rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "team-a"}, user: alice, binds: true},
+		{name: "other group", subject: rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "team-b"}, user: alice},
+		{name: "group named like the user", subject: rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "alice"}, user: alice},
+		{
+			name:    "service account",
+			subject: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-a"},
+			user:    deployer,
+			binds:   true,
+		},
+		{
+			name:    "service account of another namespace",
+			subject: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer", Namespace: "team-b"},
+			user:    deployer,
+		},
+		{
+			name:      "service account defaulting to the namespace of the RoleBinding",
+			subject:   rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer"},
+			namespace: "team-a",
+			user:      deployer,
+			binds:     true,
+		},
+		{
+			name:      "service account defaulting to another namespace",
+			subject:   rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer"},
+			namespace: "team-b",
+			user:      deployer,
+		},
+		{
+			name:    "service account without a namespace in a ClusterRoleBinding",
+			subject: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "deployer"},
+			user:    authenticationv1.UserInfo{Username: "system:serviceaccount::deployer"},
+		},
+		{name: "user named like a service account", subject: rbacv1.Subject{Kind: rbacv1.UserKind, Name: "system:serviceaccount:team-a:deployer"}, user: deployer, binds: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if binds := bindsUser([]rbacv1.Subject{tt.subject}, tt.namespace, tt.user); binds != tt.binds {
+				t.Errorf("bindsUser() = %v, want %v", binds, tt.binds)
+			}
+		})
+	}
+}
+
+func TestRBACAuthorizerAllows(t *testing.T) {
+	objects := []runtime.Object{
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "configmap-editor"},
+			Rules:      []rbacv1.PolicyRule{{Verbs: []string{"*"}, APIGroups: []string{""}, Resources: []string{"configmaps"}}},
+		},
+		&rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "namespace-reader"},
+			Rules:      []rbacv1.PolicyRule{{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"namespaces"}}},
+		},
+		&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "deployer"},
+			Rules:      []rbacv1.PolicyRule{{Verbs: []string{"create", "patch"}, APIGroups: []string{"apps"}, Resources: []string{"deployments"}}},
+		},
+		// A RoleBinding referencing a ClusterRole grants its rules in the
+		// namespace of the binding only.
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "configmap-editors"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "team-a"}},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "configmap-editor"},
+		},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "deployers"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "alice"}},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "deployer"},
+		},
+		// Cluster-scoped resources can't be granted by a RoleBinding.
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "namespace-readers"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "alice"}},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "namespace-reader"},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "auditors"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "auditors"}},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "namespace-reader"},
+		},
+		&rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "missing"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "alice"}},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "missing"},
+		},
+	}
+	a := &rbacAuthorizer{client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithRuntimeObjects(objects...).Build()}
+
+	alice := authenticationv1.UserInfo{Username: "alice", Groups: []string{"team-a"}}
+	auditor := authenticationv1.UserInfo{Username: "carol", Groups: []string{"auditors"}}
+	tests := []struct {
+		name  string
+		user  authenticationv1.UserInfo
+		key   decisionKey
+		allow bool
+	}{
+		{
+			name:  "ClusterRole through a RoleBinding",
+			user:  alice,
+			key:   decisionKey{resource: "configmaps", namespace: "team-a", name: "settings", verb: "update"},
+			allow: true,
+		},
+		{
+			name: "ClusterRole through a RoleBinding of another namespace",
+			user: alice,
+			key:  decisionKey{resource: "configmaps", namespace: "team-b", name: "settings", verb: "update"},
+		},
+		{
+			name:  "Role through a RoleBinding",
+			user:  alice,
+			key:   decisionKey{group: "apps", resource: "deployments", namespace: "team-a", verb: "create"},
+			allow: true,
+		},
+		{
+			name: "verb the Role lacks",
+			user: alice,
+			key:  decisionKey{group: "apps", resource: "deployments", namespace: "team-a", name: "web", verb: "delete"},
+		},
+		{
+			name: "cluster-scoped resource through a RoleBinding",
+			user: alice,
+			key:  decisionKey{resource: "namespaces", name: "team-a", verb: "get"},
+		},
+		{
+			name:  "cluster-scoped resource through a ClusterRoleBinding",
+			user:  auditor,
+			key:   decisionKey{resource: "namespaces", name: "team-a", verb: "get"},
+			allow: true,
+		},
+		{
+			name:  "namespaced resource through a ClusterRoleBinding",
+			user:  auditor,
+			key:   decisionKey{resource: "namespaces", namespace: "team-b", name: "team-a", verb: "get"},
+			allow: true,
+		},
+		{
+			name: "unbound user",
+			user: authenticationv1.UserInfo{Username: "mallory"},
+			key:  decisionKey{resource: "configmaps", namespace: "team-a", name: "settings", verb: "get"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, err := a.allows(context.Background(), tt.user, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allow != tt.allow {
+				t.Errorf("allows() = %v, want %v", allow, tt.allow)
+			}
+		})
+	}
+}
+
+func TestIdentityKey(t *testing.T) {
+	alice := authenticationv1.UserInfo{Username: "alice", Groups: []string{"team-a", "team-b"}}
+	if identityKey(alice) != identityKey(authenticationv1.UserInfo{Username: "alice", Groups: []string{"team-b", "team-a"}}) {
+		t.Error("the order of groups changes the identity")
+	}
+	if alice.Groups[0] != "team-a" {
+		t.Error("identityKey() sorted the groups of the user in place")
+	}
+	for _, other := range []authenticationv1.UserInfo{
+		{Username: "alice"},
+		{Username: "alice", Groups: []string{"team-a"}},
+		{Username: "alice", Groups: []string{"team-a", "team-b", "admins"}},
+		{Username: "alice", Groups: []string{"team-a,team-b"}},
+		{Username: "alice", UID: "42", Groups: []string{"team-a", "team-b"}},
+		{Username: "alice", Groups: []string{"team-a", "team-b"}, Extra: map[string]authenticationv1.ExtraValue{"scopes": {"user:full"}}},
+		{Username: "bob", Groups: []string{"team-a", "team-b"}},
+	} {
+		if identityKey(alice) == identityKey(other) {
+			t.Errorf("%+v has the same identity as %+v", other, alice)
+		}
+	}
+}
+
+// countingReview allows everything but what deny says, and counts the reviews
+// it made.
+type countingReview struct {
+	reviews int
+	deny    func(user authenticationv1.UserInfo, p permission) bool
+}
+
+func (c *countingReview) review(ctx context.Context, user authenticationv1.UserInfo, p permission) (bool, error) {
+	c.reviews++
+	return c.deny == nil || !c.deny(user, p), nil
+}
+
+func TestPermissionEvaluatorCache(t *testing.T) {
+	createConfigMap := func(name string) permission {
+		return permission{
+			ref:      argoprojiov1alpha1.ResourceRef{Version: "v1", Kind: "ConfigMap", Namespace: "team-a", Name: name},
+			resource: "configmaps",
+			verb:     "create",
+		}
+	}
+	admin := authenticationv1.UserInfo{Username: "alice", Groups: []string{"admins"}}
+	alice := authenticationv1.UserInfo{Username: "alice"}
+	ctx := context.Background()
+
+	t.Run("shared decisions", func(t *testing.T) {
+		c := &countingReview{deny: func(user authenticationv1.UserInfo, p permission) bool { return len(user.Groups) == 0 }}
+		e := newPermissionEvaluator(c.review, time.Minute, nil)
+		for _, name := range []string{"a", "b", "c"} {
+			if allowed, _ := e.allowed(ctx, admin, createConfigMap(name)); !allowed {
+				t.Errorf("create %s denied", name)
+			}
+		}
+		if c.reviews != 1 {
+			t.Errorf("%d reviews for creating ConfigMaps, want 1", c.reviews)
+		}
+		// Another set of groups doesn't reuse the decision.
+		if allowed, _ := e.allowed(ctx, alice, createConfigMap("a")); allowed {
+			t.Error("create allowed without the admins group")
+		}
+		if c.reviews != 2 {
+			t.Errorf("%d reviews, want 2", c.reviews)
+		}
+	})
+
+	patchConfigMap := func(name string) permission {
+		p := createConfigMap(name)
+		p.verb = "patch"
+		return p
+	}
+
+	t.Run("names of other verbs", func(t *testing.T) {
+		c := &countingReview{}
+		e := newPermissionEvaluator(c.review, time.Minute, nil)
+		for _, name := range []string{"a", "b"} {
+			if allowed, _ := e.allowed(ctx, admin, patchConfigMap(name)); !allowed {
+				t.Errorf("patch %s denied", name)
+			}
+		}
+		if c.reviews != 1 {
+			t.Errorf("%d reviews for patching two ConfigMaps, want 1", c.reviews)
+		}
+	})
+
+	t.Run("resource names", func(t *testing.T) {
+		// alice may only patch ConfigMap a.
+		c := &countingReview{deny: func(user authenticationv1.UserInfo, p permission) bool { return p.ref.Name != "a" }}
+		e := newPermissionEvaluator(c.review, time.Minute, nil)
+		for _, tt := range []struct {
+			name    string
+			allowed bool
+			reviews int
+		}{
+			{name: "a", allowed: true, reviews: 2},
+			{name: "b", allowed: false, reviews: 3},
+			{name: "a", allowed: true, reviews: 3},
+		} {
+			if allowed, _ := e.allowed(ctx, alice, patchConfigMap(tt.name)); allowed != tt.allowed {
+				t.Errorf("patch %s allowed = %v, want %v", tt.name, allowed, tt.allowed)
+			}
+			if c.reviews != tt.reviews {
+				t.Errorf("%d reviews after patching %s, want %d", c.reviews, tt.name, tt.reviews)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		c := &countingReview{}
+		e := newPermissionEvaluator(c.review, 0, nil)
+		e.allowed(ctx, admin, createConfigMap("a"))
+		e.allowed(ctx, admin, createConfigMap("a"))
+		if c.reviews != 2 {
+			t.Errorf("%d reviews without a cache, want 2", c.reviews)
+		}
+	})
+
+	t.Run("within a sync", func(t *testing.T) {
+		c := &countingReview{}
+		e := newPermissionEvaluator(c.review, 0, nil)
+		sync := withSyncDecisions(ctx)
+		e.allowed(sync, admin, createConfigMap("a"))
+		e.allowed(sync, admin, createConfigMap("b"))
+		if c.reviews != 1 {
+			t.Errorf("%d reviews within a sync without a cache, want 1", c.reviews)
+		}
+		e.allowed(withSyncDecisions(ctx), admin, createConfigMap("a"))
+		if c.reviews != 2 {
+			t.Errorf("%d reviews in the next sync without a cache, want 2", c.reviews)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		c := &countingReview{}
+		e := newPermissionEvaluator(c.review, 10*time.Millisecond, nil)
+		e.allowed(ctx, admin, createConfigMap("a"))
+		time.Sleep(20 * time.Millisecond)
+		e.allowed(ctx, admin, createConfigMap("a"))
+		if c.reviews != 2 {
+			t.Errorf("%d reviews across an expired decision, want 2", c.reviews)
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if n := len(e.decisions[identityKey(admin)]); n != 1 {
+			t.Errorf("%d decisions cached, want 1", n)
+		}
+	})
+
+	t.Run("local RBAC", func(t *testing.T) {
+		local := &rbacAuthorizer{client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithRuntimeObjects(
+			&rbacv1.ClusterRole{
+				ObjectMeta: metav1.ObjectMeta{Name: "configmap-creator"},
+				Rules:      []rbacv1.PolicyRule{{Verbs: []string{"create"}, APIGroups: []string{""}, Resources: []string{"configmaps"}}},
+			},
+			&rbacv1.ClusterRoleBinding{
+				ObjectMeta: metav1.ObjectMeta{Name: "admins"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "admins"}},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "configmap-creator"},
+			},
+		).Build()}
+		c := &countingReview{deny: func(authenticationv1.UserInfo, permission) bool { return true }}
+		e := newPermissionEvaluator(c.review, time.Minute, local)
+		if allowed, _ := e.allowed(ctx, admin, createConfigMap("a")); !allowed || c.reviews != 0 {
+			t.Errorf("allowed = %v after %d reviews, want a local grant", allowed, c.reviews)
+		}
+		// What RBAC doesn't grant is left to the API server.
+		if allowed, _ := e.allowed(ctx, alice, createConfigMap("a")); allowed || c.reviews != 1 {
+			t.Errorf("allowed = %v after %d reviews, want a review", allowed, c.reviews)
+		}
+	})
+}
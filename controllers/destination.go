@@ -0,0 +1,91 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// destinationNamespace returns the namespace the namespaced resources of app
+// are applied to unless they name another one.
+func destinationNamespace(app *argoprojiov1alpha1.MicroApplication) string {
+	if app.Spec.Destination != nil && app.Spec.Destination.Namespace != "" {
+		return app.Spec.Destination.Namespace
+	}
+	return app.Namespace
+}
+
+// allowsCrossNamespace tells whether the resources of an application bound to
+// project may target another namespace than its destination namespace.
+func (r *MicroApplicationReconciler) allowsCrossNamespace(project *argoprojiov1alpha1.MicroProject) bool {
+	if project != nil && project.Spec.AllowCrossNamespace != nil {
+		return *project.Spec.AllowCrossNamespace
+	}
+	return r.AllowCrossNamespace
+}
+
+// placeResources defaults the namespace of namespaced resources to the
+// destination namespace of app, and strips it from cluster-scoped resources so
+// that they are authorized, applied and recorded in the inventory without one,
+// whatever their manifest says. Unless cross-namespace resources are allowed,
+// the destination has to be the namespace of app or a destination of its
+// project, and the resources targeting another namespace are moved to it or,
+// unless spec.destination.rewriteNamespaces is set, rejected: placeResources
+// then tells why.
+func (r *MicroApplicationReconciler) placeResources(kinds *kindResolver, project *argoprojiov1alpha1.MicroProject, app *argoprojiov1alpha1.MicroApplication, resources []*unstructured.Unstructured) (string, error) {
+	destination := destinationNamespace(app)
+	var namespaced []*unstructured.Unstructured
+	for _, resource := range resources {
+		info, err := kinds.resolve(resource.GroupVersionKind())
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case info.clusterScoped:
+			resource.SetNamespace("")
+			continue
+		case resource.GetNamespace() == "":
+			resource.SetNamespace(destination)
+		}
+		namespaced = append(namespaced, resource)
+	}
+	if r.allowsCrossNamespace(project) {
+		return "", nil
+	}
+
+	if destination != app.Namespace && (project == nil || !matchesPattern(project.Spec.DestinationNamespaces, destination)) {
+		return fmt.Sprintf("destination namespace %s is not the namespace of the application, and cross-namespace resources are not allowed", destination), nil
+	}
+
+	rewrite := app.Spec.Destination != nil && app.Spec.Destination.RewriteNamespaces
+	for _, resource := range namespaced {
+		namespace := resource.GetNamespace()
+		if namespace == destination {
+			continue
+		}
+		if !rewrite {
+			return fmt.Sprintf("%s %s/%s: namespace %s is not the destination namespace %s, and cross-namespace resources are not allowed",
+				resource.GroupVersionKind().GroupKind(), namespace, resource.GetName(), namespace, destination), nil
+		}
+		resource.SetNamespace(destination)
+	}
+	return "", nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+func newTestResource(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	resource := &unstructured.Unstructured{}
+	resource.SetAPIVersion(apiVersion)
+	resource.SetKind(kind)
+	resource.SetNamespace(namespace)
+	resource.SetName(name)
+	return resource
+}
+
+func TestPlaceResources(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+	r := &MicroApplicationReconciler{mapper: mapper}
+
+	app := &argoprojiov1alpha1.MicroApplication{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"}}
+	crd := newTestResource("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", "widgets.example.com")
+	crd.Object["spec"] = map[string]interface{}{
+		"group": "example.com",
+		"names": map[string]interface{}{"kind": "Widget", "plural": "widgets"},
+		"scope": "Cluster",
+	}
+	mapper.Add(crd.GroupVersionKind(), meta.RESTScopeRoot)
+	resources := []*unstructured.Unstructured{
+		newTestResource("v1", "ConfigMap", "", "defaulted"),
+		newTestResource("v1", "ConfigMap", "team-a", "explicit"),
+		// Cluster-scoped resources are recorded without a namespace, even
+		// when their manifest sets one, and never count as cross-namespace.
+		newTestResource("v1", "Namespace", "team-b", "team-b"),
+		newTestResource("rbac.authorization.k8s.io/v1", "ClusterRole", "team-b", "reader"),
+		crd,
+		newTestResource("example.com/v1", "Widget", "team-b", "widget"),
+	}
+	violation, err := r.placeResources(r.newKindResolver(resources), nil, app, resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if violation != "" {
+		t.Fatalf("unexpected violation: %s", violation)
+	}
+	for i, want := range []string{"team-a", "team-a", "", "", "", ""} {
+		if namespace := resources[i].GetNamespace(); namespace != want {
+			t.Errorf("%s %s placed in %q, want %q", resources[i].GetKind(), resources[i].GetName(), namespace, want)
+		}
+	}
+
+	violation, err = r.placeResources(r.newKindResolver(nil), nil, app, []*unstructured.Unstructured{newTestResource("v1", "ConfigMap", "team-b", "other")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if violation == "" {
+		t.Error("cross-namespace ConfigMap accepted")
+	}
+}
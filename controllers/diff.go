@@ -0,0 +1,192 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+const (
+	// maxFieldChanges is the number of changed fields recorded per resource.
+	maxFieldChanges = 20
+	// maxFieldValueLength is the length values of changed fields are
+	// truncated to.
+	maxFieldValueLength = 100
+)
+
+// resourceDiff is what applying a resource would change in the cluster.
+type resourceDiff struct {
+	// exists tells whether the resource is already in the cluster.
+	exists bool
+	// live is the resource as it is in the cluster, if it exists.
+	live *unstructured.Unstructured
+	// fields lists the changed fields of an existing resource.
+	fields []argoprojiov1alpha1.FieldChange
+}
+
+// changed tells whether applying the resource would change anything.
+func (d *resourceDiff) changed() bool {
+	return !d.exists || len(d.fields) > 0
+}
+
+// change describes d as the ResourceChange of the resource identified by ref,
+// or returns nil when nothing would change.
+func (d *resourceDiff) change(ref argoprojiov1alpha1.ResourceRef) *argoprojiov1alpha1.ResourceChange {
+	switch {
+	case !d.exists:
+		return &argoprojiov1alpha1.ResourceChange{ResourceRef: ref, Action: argoprojiov1alpha1.ChangeCreate}
+	case d.changed():
+		return &argoprojiov1alpha1.ResourceChange{ResourceRef: ref, Action: argoprojiov1alpha1.ChangeUpdate, Fields: d.fields}
+	}
+	return nil
+}
+
+// diffResource compares the live state of resource, read with c, with what a
+// server-side apply of it would produce, as returned by a dry-run. Comparing
+// against the dry-run rather than the manifest takes defaulting, admission and
+// the fields owned by other managers into account. Resources which don't exist
+// yet are dry-run too, so that a creation the API server would reject is
+// reported as an error rather than as a change.
+func diffResource(ctx context.Context, c client.Client, resource *unstructured.Unstructured) (*resourceDiff, error) {
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(resource.GroupVersionKind())
+	err := c.Get(ctx, client.ObjectKey{Namespace: resource.GetNamespace(), Name: resource.GetName()}, live)
+	exists := !apierrors.IsNotFound(err)
+	if exists && err != nil {
+		return nil, err
+	}
+
+	desired := resource.DeepCopy()
+	err = c.Patch(ctx, desired, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership, client.DryRunAll)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return &resourceDiff{exists: false}, nil
+	}
+
+	d := &resourceDiff{exists: true, live: live}
+	redact := resource.GroupVersionKind().Group == "" && resource.GetKind() == "Secret"
+	diffFields("", comparable(live), comparable(desired), redact, &d.fields)
+	if len(d.fields) > maxFieldChanges {
+		d.fields = d.fields[:maxFieldChanges]
+	}
+	return d, nil
+}
+
+// diffResources diffs every resource with c: diffs[i] is the diff of
+// resources[i], or nil when it couldn't be computed, errs[i] telling why.
+func diffResources(ctx context.Context, c client.Client, resources []*unstructured.Unstructured) (diffs []*resourceDiff, errs []error) {
+	diffs = make([]*resourceDiff, len(resources))
+	errs = make([]error, len(resources))
+	for i, resource := range resources {
+		diffs[i], errs[i] = diffResource(ctx, c, resource)
+	}
+	return diffs, errs
+}
+
+// comparable returns the content of obj which is relevant to a diff, leaving
+// out the status and the metadata maintained by the API server.
+func comparable(obj *unstructured.Unstructured) map[string]interface{} {
+	content := obj.DeepCopy().Object
+	delete(content, "status")
+	if metadata, ok := content["metadata"].(map[string]interface{}); ok {
+		for _, field := range []string{"managedFields", "resourceVersion", "generation", "creationTimestamp", "uid", "selfLink"} {
+			delete(metadata, field)
+		}
+	}
+	return content
+}
+
+// diffFields appends the fields which differ between old and new, both
+// decoded JSON values, below path to changes.
+func diffFields(path string, old, new interface{}, redact bool, changes *[]argoprojiov1alpha1.FieldChange) {
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := map[string]bool{}
+		for k := range oldMap {
+			keys[k] = true
+		}
+		for k := range newMap {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			diffFields(path+"."+k, oldMap[k], newMap[k], redact, changes)
+		}
+		return
+	}
+
+	oldList, oldIsList := old.([]interface{})
+	newList, newIsList := new.([]interface{})
+	if oldIsList && newIsList && len(oldList) == len(newList) {
+		for i := range oldList {
+			diffFields(fmt.Sprintf("%s[%d]", path, i), oldList[i], newList[i], redact, changes)
+		}
+		return
+	}
+
+	change := argoprojiov1alpha1.FieldChange{Path: path}
+	if redact && (strings.HasPrefix(path, ".data") || strings.HasPrefix(path, ".stringData")) {
+		if old != nil {
+			change.Old = "<redacted>"
+		}
+		if new != nil {
+			change.New = "<redacted>"
+		}
+	} else {
+		change.Old = fieldValue(old)
+		change.New = fieldValue(new)
+	}
+	*changes = append(*changes, change)
+}
+
+// fieldValue JSON encodes a field value for display, truncating long values.
+func fieldValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	s := string(data)
+	if len(s) > maxFieldValueLength {
+		s = s[:maxFieldValueLength] + "..."
+	}
+	return s
+}
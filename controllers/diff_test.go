@@ -0,0 +1,152 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+func TestDiffFields(t *testing.T) {
+	long := strings.Repeat("x", maxFieldValueLength)
+	tests := []struct {
+		name   string
+		old    interface{}
+		new    interface{}
+		redact bool
+		want   []argoprojiov1alpha1.FieldChange
+	}{
+		{
+			name: "equal",
+			old:  map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1)}},
+			new:  map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1)}},
+		},
+		{
+			name: "changed",
+			old:  map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1), "paused": true}},
+			new:  map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(2), "paused": true}},
+			want: []argoprojiov1alpha1.FieldChange{{Path: ".spec.replicas", Old: "1", New: "2"}},
+		},
+		{
+			name: "added and removed, in order",
+			old:  map[string]interface{}{"b": "old", "c": "same"},
+			new:  map[string]interface{}{"a": "new", "c": "same"},
+			want: []argoprojiov1alpha1.FieldChange{{Path: ".a", New: `"new"`}, {Path: ".b", Old: `"old"`}},
+		},
+		{
+			name: "list items",
+			old:  map[string]interface{}{"containers": []interface{}{map[string]interface{}{"image": "web:1"}}},
+			new:  map[string]interface{}{"containers": []interface{}{map[string]interface{}{"image": "web:2"}}},
+			want: []argoprojiov1alpha1.FieldChange{{Path: ".containers[0].image", Old: `"web:1"`, New: `"web:2"`}},
+		},
+		{
+			name: "list length",
+			old:  map[string]interface{}{"args": []interface{}{"a"}},
+			new:  map[string]interface{}{"args": []interface{}{"a", "b"}},
+			want: []argoprojiov1alpha1.FieldChange{{Path: ".args", Old: `["a"]`, New: `["a","b"]`}},
+		},
+		{
+			name: "type",
+			old:  map[string]interface{}{"port": "http"},
+			new:  map[string]interface{}{"port": int64(80)},
+			want: []argoprojiov1alpha1.FieldChange{{Path: ".port", Old: `"http"`, New: "80"}},
+		},
+		{
+			name: "truncated",
+			old:  map[string]interface{}{"value": ""},
+			new:  map[string]interface{}{"value": long},
+			want: []argoprojiov1alpha1.FieldChange{{Path: ".value", Old: `""`, New: `"` + long[:maxFieldValueLength-1] + "..."}},
+		},
+		{
+			name:   "secret data",
+			old:    map[string]interface{}{"data": map[string]interface{}{"password": "b2xk", "removed": "eA=="}},
+			new:    map[string]interface{}{"data": map[string]interface{}{"password": "bmV3", "added": "eQ=="}},
+			redact: true,
+			want: []argoprojiov1alpha1.FieldChange{
+				{Path: ".data.added", New: "<redacted>"},
+				{Path: ".data.password", Old: "<redacted>", New: "<redacted>"},
+				{Path: ".data.removed", Old: "<redacted>"},
+			},
+		},
+		{
+			name:   "secret string data",
+			old:    map[string]interface{}{},
+			new:    map[string]interface{}{"stringData": map[string]interface{}{"password": "new"}},
+			redact: true,
+			want:   []argoprojiov1alpha1.FieldChange{{Path: ".stringData", New: "<redacted>"}},
+		},
+		{
+			name:   "secret metadata",
+			old:    map[string]interface{}{"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "web"}}},
+			new:    map[string]interface{}{"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "db"}}},
+			redact: true,
+			want:   []argoprojiov1alpha1.FieldChange{{Path: ".metadata.labels.app", Old: `"web"`, New: `"db"`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changes []argoprojiov1alpha1.FieldChange
+			diffFields("", tt.old, tt.new, tt.redact, &changes)
+			if !reflect.DeepEqual(changes, tt.want) {
+				t.Errorf("diffFields() = %+v, want %+v", changes, tt.want)
+			}
+		})
+	}
+}
+
+func TestComparable(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":              "web",
+			"namespace":         "team-a",
+			"labels":            map[string]interface{}{"app": "web"},
+			"managedFields":     []interface{}{map[string]interface{}{"manager": "kubectl"}},
+			"resourceVersion":   "42",
+			"generation":        int64(3),
+			"creationTimestamp": "2021-01-01T00:00:00Z",
+			"uid":               "1234",
+			"selfLink":          "/apis/apps/v1/namespaces/team-a/deployments/web",
+		},
+		"spec":   map[string]interface{}{"replicas": int64(2)},
+		"status": map[string]interface{}{"readyReplicas": int64(2)},
+	}}
+	original := obj.DeepCopy()
+
+	want := map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":      "web",
+			"namespace": "team-a",
+			"labels":    map[string]interface{}{"app": "web"},
+		},
+		"spec": map[string]interface{}{"replicas": int64(2)},
+	}
+	if got := comparable(obj); !reflect.DeepEqual(got, want) {
+		t.Errorf("comparable() = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(obj, original) {
+		t.Error("comparable() modified its argument")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// finalizer holds a MicroApplication back until its resources and its
+// workspace are cleaned up.
+const finalizer = "microapplications.argoproj.io/finalizer"
+
+// workspacePath is where the repository of app is cloned to.
+func (r *MicroApplicationReconciler) workspacePath(app *argoprojiov1alpha1.MicroApplication) string {
+	return filepath.Join(r.Workspace, app.Namespace, app.Name)
+}
+
+// prepareWorkspace creates the directory repositories are cloned to, if
+// missing, and makes sure only the controller can read it. The same directory
+// is reused across restarts so that clones are cleaned up by the finalizer
+// rather than left behind in a directory nobody remembers.
+func prepareWorkspace(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("workspace %s is not a directory", dir)
+	}
+	// Fails unless the directory belongs to the controller.
+	return os.Chmod(dir, 0700)
+}
+
+// ensureFinalizer adds the finalizer to app if it doesn't have it yet.
+func (r *MicroApplicationReconciler) ensureFinalizer(ctx context.Context, app *argoprojiov1alpha1.MicroApplication) error {
+	if controllerutil.ContainsFinalizer(app, finalizer) {
+		return nil
+	}
+	controllerutil.AddFinalizer(app, finalizer)
+	return r.Update(ctx, app)
+}
+
+// finalize cleans up after a deleted app: with the Delete deletion policy,
+// every resource in its inventory is deleted on behalf of its creator, then
+// its workspace is removed and the finalizer released. Resources which can't
+// be deleted, or which have nobody to be deleted on behalf of when a creator
+// is required, keep the finalizer in place, so that nothing is left behind
+// silently; switching to the Orphan policy releases it.
+func (r *MicroApplicationReconciler) finalize(ctx context.Context, log logr.Logger, app *argoprojiov1alpha1.MicroApplication) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(app, finalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	if app.Spec.DeletionPolicy == argoprojiov1alpha1.DeletionPolicyDelete {
+		creator := r.creatorOf(app)
+		if r.creatorMissing(creator) {
+			setCondition(app, argoprojiov1alpha1.ConditionSynced, metav1.ConditionFalse, reasonDeletionFailed, creatorMissingMessage)
+			r.updateStatus(ctx, log, app)
+			return ctrl.Result{}, nil
+		}
+		r.auditPrivileged(app, creator, "Deleting resources")
+		c, err := r.clientFor(creator)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		statuses, remaining, err := r.pruneResources(ctx, log, c, app, creator, app.Status.Inventory)
+		if err != nil {
+			setResources(app, statuses)
+			app.Status.Inventory = remaining
+			setCondition(app, argoprojiov1alpha1.ConditionSynced, metav1.ConditionFalse, reasonDeletionFailed, err.Error())
+			r.updateStatus(ctx, log, app)
+			return ctrl.Result{}, err
+		}
+		log.Info("deleted managed resources", "count", len(statuses))
+	}
+
+	if err := os.RemoveAll(r.workspacePath(app)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	controllerutil.RemoveFinalizer(app, finalizer)
+	return ctrl.Result{}, r.Update(ctx, app)
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const remoteName = "origin"
+
+// Keys of the Secret referenced by spec.source.secretRef.
+const (
+	// secretUsernameKey and secretPasswordKey hold HTTPS basic auth
+	// credentials. For SSH, the username defaults to the one in the URL.
+	secretUsernameKey = "username"
+	secretPasswordKey = "password"
+	// secretTokenKey holds an HTTPS access token, sent as the basic auth
+	// password.
+	secretTokenKey = "token"
+	// secretSSHPrivateKeyKey holds a PEM encoded SSH private key.
+	secretSSHPrivateKeyKey = "sshPrivateKey"
+	// secretKnownHostsKey holds the known_hosts entries the SSH server is
+	// verified against. It is required along with an SSH private key.
+	secretKnownHostsKey = "known_hosts"
+)
+
+// fetchRefSpecs mirrors every branch of the remote into refs/remotes/origin
+// and every tag into refs/tags, so that any revision can be resolved locally.
+var fetchRefSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/remotes/origin/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// cloneRepository makes sure clonePath holds a clone of cloneURL with
+// targetRevision checked out, and returns the hash of the checked out commit.
+//
+// targetRevision may be a branch, a tag or a commit SHA. An empty revision or
+// HEAD means the default branch of the remote. Branches are re-resolved against
+// the remote on every call, while tags and full commit SHAs are treated as
+// immutable: once checked out, no further fetch is made for them.
+//
+// auth may be nil for public repositories.
+func cloneRepository(cloneURL string, clonePath string, targetRevision string, auth transport.AuthMethod) (string, error) {
+	repo, err := openRepository(cloneURL, clonePath, auth)
+	if err != nil {
+		return "", err
+	}
+
+	if hash, ok := pinnedRevision(repo, targetRevision); ok {
+		head, err := repo.Head()
+		if err == nil && head.Hash() == hash {
+			return hash.String(), nil
+		}
+	}
+
+	err = repo.Fetch(&git.FetchOptions{
+		RemoteName: remoteName,
+		RefSpecs:   fetchRefSpecs,
+		Tags:       git.AllTags,
+		Force:      true,
+		Auth:       auth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", err
+	}
+
+	hash, err := resolveRevision(repo, targetRevision, auth)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	err = w.Checkout(&git.CheckoutOptions{Hash: hash, Force: true})
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// openRepository opens the clone at clonePath, cloning it first if it doesn't
+// exist yet or if it was cloned from a different URL.
+func openRepository(cloneURL string, clonePath string, auth transport.AuthMethod) (*git.Repository, error) {
+	repo, err := git.PlainOpen(clonePath)
+	if err == nil {
+		remote, err := repo.Remote(remoteName)
+		if err == nil && len(remote.Config().URLs) > 0 && remote.Config().URLs[0] == cloneURL {
+			return repo, nil
+		}
+
+		// The repoURL was changed, start over from a fresh clone.
+		if err := os.RemoveAll(clonePath); err != nil {
+			return nil, err
+		}
+	} else if err != git.ErrRepositoryNotExists {
+		return nil, err
+	}
+
+	return git.PlainClone(clonePath, false, &git.CloneOptions{
+		URL:        cloneURL,
+		RemoteName: remoteName,
+		Auth:       auth,
+	})
+}
+
+// pinnedRevision returns the commit an immutable revision (tag or full commit
+// SHA) points to, if it is already present in the local clone.
+func pinnedRevision(repo *git.Repository, targetRevision string) (plumbing.Hash, bool) {
+	if plumbing.IsHash(targetRevision) {
+		commit, err := repo.CommitObject(plumbing.NewHash(targetRevision))
+		if err != nil {
+			return plumbing.ZeroHash, false
+		}
+		return commit.Hash, true
+	}
+	if targetRevision == "" || targetRevision == "HEAD" {
+		return plumbing.ZeroHash, false
+	}
+
+	// A branch with the same name as the tag wins in resolveRevision, so the
+	// tag can only be considered pinned if there is no such branch.
+	if _, err := repo.Reference(plumbing.NewRemoteReferenceName(remoteName, targetRevision), false); err == nil {
+		return plumbing.ZeroHash, false
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(plumbing.NewTagReferenceName(targetRevision)))
+	if err != nil {
+		return plumbing.ZeroHash, false
+	}
+	return *hash, true
+}
+
+// resolveRevision resolves targetRevision to a commit, looking it up as a
+// remote branch, a tag, a fully qualified reference, a fully qualified branch
+// and finally as a (possibly abbreviated) commit SHA, in that order.
+func resolveRevision(repo *git.Repository, targetRevision string, auth transport.AuthMethod) (plumbing.Hash, error) {
+	if targetRevision == "" || targetRevision == "HEAD" {
+		branch, err := remoteDefaultBranch(repo, auth)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		targetRevision = branch
+	}
+
+	candidates := []plumbing.ReferenceName{
+		plumbing.NewRemoteReferenceName(remoteName, targetRevision),
+		plumbing.NewTagReferenceName(targetRevision),
+		plumbing.ReferenceName(targetRevision),
+	}
+	// Branches only exist locally as remote-tracking references.
+	if name := plumbing.ReferenceName(targetRevision); name.IsBranch() {
+		candidates = append(candidates, plumbing.NewRemoteReferenceName(remoteName, name.Short()))
+	}
+	for _, name := range candidates {
+		if _, err := repo.Reference(name, true); err != nil {
+			continue
+		}
+		// ResolveRevision peels annotated tags down to the commit.
+		hash, err := repo.ResolveRevision(plumbing.Revision(name))
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return *hash, nil
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(targetRevision))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to resolve revision %q: %v", targetRevision, err)
+	}
+	return *hash, nil
+}
+
+// remoteDefaultBranch returns the short name of the branch HEAD points to on
+// the remote.
+func remoteDefaultBranch(repo *git.Repository, auth transport.AuthMethod) (string, error) {
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return "", err
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return "", err
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			return ref.Target().Short(), nil
+		}
+	}
+	return "", fmt.Errorf("unable to determine the default branch of %s", remote.Config().URLs[0])
+}
+
+// gitAuth builds the credentials used to access cloneURL from secret, see the
+// secret*Key constants for the keys it may hold.
+func gitAuth(cloneURL string, secret *corev1.Secret) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(cloneURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch endpoint.Protocol {
+	case "ssh":
+		privateKey := secret.Data[secretSSHPrivateKeyKey]
+		if len(privateKey) == 0 {
+			return nil, fmt.Errorf("secret %s has no %s for SSH repository %s", secret.Name, secretSSHPrivateKeyKey, cloneURL)
+		}
+		knownHosts := secret.Data[secretKnownHostsKey]
+		if len(knownHosts) == 0 {
+			return nil, fmt.Errorf("secret %s has no %s to verify the SSH server of %s", secret.Name, secretKnownHostsKey, cloneURL)
+		}
+
+		user := endpoint.User
+		if username := string(secret.Data[secretUsernameKey]); username != "" {
+			user = username
+		}
+		auth, err := ssh.NewPublicKeys(user, privateKey, string(secret.Data[secretPasswordKey]))
+		if err != nil {
+			return nil, err
+		}
+		auth.HostKeyCallback, err = knownHostsCallback(knownHosts)
+		if err != nil {
+			return nil, err
+		}
+		return auth, nil
+
+	case "http", "https":
+		username := string(secret.Data[secretUsernameKey])
+		password := string(secret.Data[secretPasswordKey])
+		if token := string(secret.Data[secretTokenKey]); token != "" {
+			password = token
+			if username == "" {
+				// Git hosts ignore the username when a token is used, but it
+				// can't be empty.
+				username = "git"
+			}
+		}
+		if password == "" {
+			return nil, fmt.Errorf("secret %s has neither %s nor %s for repository %s", secret.Name, secretPasswordKey, secretTokenKey, cloneURL)
+		}
+		return &http.BasicAuth{Username: username, Password: password}, nil
+	}
+	return nil, fmt.Errorf("credentials are not supported for %s repository %s", endpoint.Protocol, cloneURL)
+}
+
+// knownHostsCallback returns a host key callback which only accepts the hosts
+// listed in knownHosts, in the known_hosts file format.
+func knownHostsCallback(knownHosts []byte) (gossh.HostKeyCallback, error) {
+	f, err := ioutil.TempFile("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(knownHosts)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The file is read right away, it can go once the callback exists.
+	return ssh.NewKnownHostsCallback(f.Name())
+}
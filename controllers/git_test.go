@@ -0,0 +1,198 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// testUpstream is a repository standing in for a Git server.
+type testUpstream struct {
+	t    *testing.T
+	dir  string
+	repo *git.Repository
+}
+
+func newTestUpstream(t *testing.T) *testUpstream {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testUpstream{t: t, dir: dir, repo: repo}
+}
+
+// commit commits content to the branch HEAD points to.
+func (u *testUpstream) commit(content string) plumbing.Hash {
+	w, err := u.repo.Worktree()
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(u.dir, "cm.yaml"), []byte(content), 0644); err != nil {
+		u.t.Fatal(err)
+	}
+	if _, err := w.Add("cm.yaml"); err != nil {
+		u.t.Fatal(err)
+	}
+	hash, err := w.Commit(content, &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	return hash
+}
+
+func (u *testUpstream) setRef(name plumbing.ReferenceName, hash plumbing.Hash) {
+	if err := u.repo.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+		u.t.Fatal(err)
+	}
+}
+
+func (u *testUpstream) tag(name string, hash plumbing.Hash, annotated bool) {
+	var opts *git.CreateTagOptions
+	if annotated {
+		opts = &git.CreateTagOptions{Message: name, Tagger: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}}
+	}
+	if _, err := u.repo.CreateTag(name, hash, opts); err != nil {
+		u.t.Fatal(err)
+	}
+}
+
+func TestCloneRepositoryRevisions(t *testing.T) {
+	upstream := newTestUpstream(t)
+	first := upstream.commit("first")
+	second := upstream.commit("second")
+	upstream.setRef(plumbing.NewBranchReferenceName("feature"), first)
+	upstream.tag("v1.0.0", first, false)
+	upstream.tag("v2.0.0", second, true)
+	// A branch and a tag sharing a name: the branch wins.
+	upstream.setRef(plumbing.NewBranchReferenceName("release"), second)
+	upstream.tag("release", first, false)
+
+	tests := []struct {
+		targetRevision string
+		want           plumbing.Hash
+		wantErr        bool
+	}{
+		{targetRevision: "", want: second},
+		{targetRevision: "HEAD", want: second},
+		{targetRevision: "master", want: second},
+		{targetRevision: "feature", want: first},
+		{targetRevision: "refs/heads/feature", want: first},
+		{targetRevision: "v1.0.0", want: first},
+		{targetRevision: "v2.0.0", want: second},
+		{targetRevision: "refs/tags/v1.0.0", want: first},
+		{targetRevision: "release", want: second},
+		{targetRevision: first.String(), want: first},
+		{targetRevision: "missing", wantErr: true},
+	}
+	workspace, err := ioutil.TempDir("", "clones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspace)
+	for i, tt := range tests {
+		t.Run(tt.targetRevision, func(t *testing.T) {
+			hash, err := cloneRepository(upstream.dir, filepath.Join(workspace, string(rune('a'+i))), tt.targetRevision, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("cloneRepository() = %s, want an error", hash)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hash != tt.want.String() {
+				t.Errorf("cloneRepository() = %s, want %s", hash, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloneRepositoryFollowsBranches(t *testing.T) {
+	upstream := newTestUpstream(t)
+	first := upstream.commit("first")
+	upstream.tag("v1.0.0", first, false)
+	clone, err := ioutil.TempDir("", "clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(clone)
+
+	for _, revision := range []string{"master", "v1.0.0"} {
+		if _, err := cloneRepository(upstream.dir, clone, revision, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo, err := git.PlainOpen(clone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, ok := pinnedRevision(repo, "v1.0.0"); !ok || hash != first {
+		t.Errorf("pinnedRevision(v1.0.0) = %s, %v, want %s", hash, ok, first)
+	}
+	if hash, ok := pinnedRevision(repo, first.String()); !ok || hash != first {
+		t.Errorf("pinnedRevision(%s) = %s, %v, want it pinned", first, hash, ok)
+	}
+	for _, revision := range []string{"", "HEAD", "master", "0123456789abcdef0123456789abcdef01234567"} {
+		if _, ok := pinnedRevision(repo, revision); ok {
+			t.Errorf("pinnedRevision(%q) is pinned", revision)
+		}
+	}
+
+	second := upstream.commit("second")
+	for revision, want := range map[string]plumbing.Hash{"master": second, "v1.0.0": first, "": second} {
+		hash, err := cloneRepository(upstream.dir, clone, revision, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != want.String() {
+			t.Errorf("cloneRepository(%q) = %s after a push, want %s", revision, hash, want)
+		}
+	}
+
+	// The default branch is read from the remote.
+	w, err := upstream.repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("main"), Hash: first, Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if branch, err := remoteDefaultBranch(repo, nil); err != nil || branch != "main" {
+		t.Errorf("remoteDefaultBranch() = %q, %v, want main", branch, err)
+	}
+	hash, err := cloneRepository(upstream.dir, clone, "HEAD", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != first.String() {
+		t.Errorf("cloneRepository(HEAD) = %s once the default branch changed, want %s", hash, first)
+	}
+}
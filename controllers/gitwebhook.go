@@ -0,0 +1,410 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// GitWebhookPath is the path the GitWebhookReceiver serves push events on.
+const GitWebhookPath = "/webhook"
+
+// maxPayloadSize is the largest payload accepted, GitHub caps its payloads at
+// 25MB.
+const maxPayloadSize = 25 << 20
+
+// GitWebhookReceiver receives push events from GitHub, GitLab, Gitea and
+// Bitbucket and triggers a sync of the MicroApplications following the pushed
+// branch or tag.
+type GitWebhookReceiver struct {
+	client.Client
+	Log logr.Logger
+
+	// Addr is the address the receiver listens on.
+	Addr string
+	// Secret is the secret configured on the webhooks. It's the HMAC key for
+	// GitHub, Gitea and Bitbucket, and the token for GitLab.
+	Secret []byte
+	// Events receives the MicroApplications to sync.
+	Events chan<- event.GenericEvent
+	// Elected is closed once this replica is the leader, and drains Events.
+	// Until then push events are answered with 503 Service Unavailable, for
+	// the provider to deliver them again. Nil means always elected.
+	Elected <-chan struct{}
+}
+
+// pushEvent is what the receiver needs to know about a push, whatever the
+// provider.
+type pushEvent struct {
+	// repoURLs are the URLs the repository can be cloned from.
+	repoURLs []string
+	// refs are the fully qualified references which were pushed.
+	refs []string
+	// defaultBranch is the default branch of the repository, if the provider
+	// sends it.
+	defaultBranch string
+}
+
+// NeedLeaderElection allows every replica to listen for push events, so that
+// they can be turned away by the replicas which aren't the leader rather than
+// refused at the connection. Only the leader runs the controller.
+func (g *GitWebhookReceiver) NeedLeaderElection() bool {
+	return false
+}
+
+// Start serves push events until ctx is done.
+func (g *GitWebhookReceiver) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle(GitWebhookPath, g)
+	srv := &http.Server{
+		Addr:    g.Addr,
+		Handler: mux,
+		// The receiver is usually exposed to the internet, slow clients
+		// mustn't be able to hold connections open.
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    64 << 10,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		g.Log.Info("starting git webhook receiver", "address", g.Addr)
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
+
+// ServeHTTP validates and parses a push event, then triggers a sync of every
+// MicroApplication following one of the pushed refs.
+func (g *GitWebhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.elected() {
+		http.Error(w, "not the leader, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxPayloadSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	push, err := g.parsePush(req.Header, body)
+	if err == errUnauthorized {
+		g.Log.Info("rejecting webhook with an invalid signature", "remoteAddr", req.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if push == nil {
+		// Not a push, e.g. the ping GitHub sends when the webhook is created.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	apps := &argoprojiov1alpha1.MicroApplicationList{}
+	if err := g.List(req.Context(), apps); err != nil {
+		g.Log.Error(err, "unable to list MicroApplications")
+		http.Error(w, "unable to list MicroApplications", http.StatusInternalServerError)
+		return
+	}
+
+	triggered := 0
+	for i := range apps.Items {
+		app := &apps.Items[i]
+		if !push.matches(app) {
+			continue
+		}
+		select {
+		case g.Events <- event.GenericEvent{Object: app}:
+			g.Log.Info("triggering sync after push", "microapplication", trackingID(app), "refs", push.refs)
+			triggered++
+		default:
+			g.Log.Info("dropping push event, the controller isn't consuming them", "microapplication", trackingID(app))
+		}
+	}
+	fmt.Fprintf(w, "triggered %d syncs\n", triggered)
+}
+
+// elected tells whether this replica is the leader, whose controller drains
+// Events.
+func (g *GitWebhookReceiver) elected() bool {
+	if g.Elected == nil {
+		return true
+	}
+	select {
+	case <-g.Elected:
+		return true
+	default:
+		return false
+	}
+}
+
+// errUnauthorized is returned when a payload isn't signed with the secret.
+var errUnauthorized = fmt.Errorf("invalid webhook signature")
+
+// parsePush authenticates and parses a payload, detecting the provider from
+// its headers. It returns nil for events other than pushes.
+func (g *GitWebhookReceiver) parsePush(header http.Header, body []byte) (*pushEvent, error) {
+	switch {
+	// Gitea also sends the GitHub headers, it has to be looked at first.
+	case header.Get("X-Gitea-Event") != "":
+		if !validHMAC(g.Secret, body, header.Get("X-Gitea-Signature")) {
+			return nil, errUnauthorized
+		}
+		if header.Get("X-Gitea-Event") != "push" {
+			return nil, nil
+		}
+		return parseGitHubPush(body)
+
+	case header.Get("X-GitHub-Event") != "":
+		if !validHMAC(g.Secret, body, strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256=")) {
+			return nil, errUnauthorized
+		}
+		if header.Get("X-GitHub-Event") != "push" {
+			return nil, nil
+		}
+		return parseGitHubPush(body)
+
+	case header.Get("X-Gitlab-Event") != "":
+		if subtle.ConstantTimeCompare(g.Secret, []byte(header.Get("X-Gitlab-Token"))) != 1 {
+			return nil, errUnauthorized
+		}
+		if event := header.Get("X-Gitlab-Event"); event != "Push Hook" && event != "Tag Push Hook" {
+			return nil, nil
+		}
+		return parseGitLabPush(body)
+
+	case header.Get("X-Event-Key") != "":
+		if !validHMAC(g.Secret, body, strings.TrimPrefix(header.Get("X-Hub-Signature"), "sha256=")) {
+			return nil, errUnauthorized
+		}
+		switch header.Get("X-Event-Key") {
+		case "repo:push":
+			return parseBitbucketCloudPush(body)
+		case "repo:refs_changed":
+			return parseBitbucketServerPush(body)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported webhook, expected a GitHub, GitLab, Gitea or Bitbucket push event")
+}
+
+// validHMAC tells whether signature is the hex encoded HMAC-SHA256 of body.
+func validHMAC(secret []byte, body []byte, signature string) bool {
+	actual, err := hex.DecodeString(signature)
+	if err != nil || len(secret) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(actual, mac.Sum(nil))
+}
+
+func parseGitHubPush(body []byte) (*pushEvent, error) {
+	var payload struct {
+		Ref        string `json:"ref"`
+		Repository struct {
+			CloneURL      string `json:"clone_url"`
+			SSHURL        string `json:"ssh_url"`
+			HTMLURL       string `json:"html_url"`
+			DefaultBranch string `json:"default_branch"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	return &pushEvent{
+		repoURLs:      []string{payload.Repository.CloneURL, payload.Repository.SSHURL, payload.Repository.HTMLURL},
+		refs:          []string{payload.Ref},
+		defaultBranch: payload.Repository.DefaultBranch,
+	}, nil
+}
+
+func parseGitLabPush(body []byte) (*pushEvent, error) {
+	var payload struct {
+		Ref     string `json:"ref"`
+		Project struct {
+			GitHTTPURL    string `json:"git_http_url"`
+			GitSSHURL     string `json:"git_ssh_url"`
+			WebURL        string `json:"web_url"`
+			DefaultBranch string `json:"default_branch"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	return &pushEvent{
+		repoURLs:      []string{payload.Project.GitHTTPURL, payload.Project.GitSSHURL, payload.Project.WebURL},
+		refs:          []string{payload.Ref},
+		defaultBranch: payload.Project.DefaultBranch,
+	}, nil
+}
+
+func parseBitbucketCloudPush(body []byte) (*pushEvent, error) {
+	var payload struct {
+		Repository struct {
+			Links struct {
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+			} `json:"links"`
+		} `json:"repository"`
+		Push struct {
+			Changes []struct {
+				New *struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				} `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	push := &pushEvent{repoURLs: []string{payload.Repository.Links.HTML.Href}}
+	for _, change := range payload.Push.Changes {
+		// New is null when a branch or tag is deleted.
+		if change.New == nil {
+			continue
+		}
+		switch change.New.Type {
+		case "branch":
+			push.refs = append(push.refs, "refs/heads/"+change.New.Name)
+		case "tag":
+			push.refs = append(push.refs, "refs/tags/"+change.New.Name)
+		}
+	}
+	return push, nil
+}
+
+func parseBitbucketServerPush(body []byte) (*pushEvent, error) {
+	var payload struct {
+		Repository struct {
+			Links struct {
+				Clone []struct {
+					Href string `json:"href"`
+				} `json:"clone"`
+			} `json:"links"`
+		} `json:"repository"`
+		Changes []struct {
+			RefID string `json:"refId"`
+			Type  string `json:"type"`
+		} `json:"changes"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	push := &pushEvent{}
+	for _, link := range payload.Repository.Links.Clone {
+		push.repoURLs = append(push.repoURLs, link.Href)
+	}
+	for _, change := range payload.Changes {
+		if change.Type != "DELETE" {
+			push.refs = append(push.refs, change.RefID)
+		}
+	}
+	return push, nil
+}
+
+// matches tells whether app follows one of the refs pushed to the repository.
+// Applications pinned to a commit never match.
+func (p *pushEvent) matches(app *argoprojiov1alpha1.MicroApplication) bool {
+	appRepo := repoKey(app.Spec.RepoURL)
+	if appRepo == "" {
+		return false
+	}
+	sameRepo := false
+	for _, u := range p.repoURLs {
+		if repoKey(u) == appRepo {
+			sameRepo = true
+			break
+		}
+	}
+	if !sameRepo {
+		return false
+	}
+
+	target := app.Spec.TargetRevision
+	for _, ref := range p.refs {
+		if ref == target {
+			return true
+		}
+		if branch := strings.TrimPrefix(ref, "refs/heads/"); branch != ref {
+			if branch == target {
+				return true
+			}
+			// Without a target revision the default branch is synced. When the
+			// provider doesn't tell which branch that is, sync anyway.
+			if (target == "" || target == "HEAD") && (p.defaultBranch == "" || p.defaultBranch == branch) {
+				return true
+			}
+		}
+		if tag := strings.TrimPrefix(ref, "refs/tags/"); tag != ref && tag == target {
+			return true
+		}
+	}
+	return false
+}
+
+// repoKey reduces a repository URL to host/path, so that the HTTPS, SSH and
+// web URLs of a repository compare equal.
+func repoKey(repoURL string) string {
+	if repoURL == "" {
+		return ""
+	}
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return ""
+	}
+	path := strings.TrimSuffix(strings.Trim(endpoint.Path, "/"), ".git")
+	return strings.ToLower(endpoint.Host + "/" + path)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// assessHealth derives the health of a live object from its status. Kinds
+// without a well-known notion of health are considered healthy as soon as the
+// API server accepted them.
+func assessHealth(obj *unstructured.Unstructured) argoprojiov1alpha1.ResourceHealth {
+	gvk := obj.GroupVersionKind()
+	switch {
+	case gvk.Group == "apps" && gvk.Kind == "Deployment":
+		return deploymentHealth(obj)
+	case gvk.Group == "apps" && gvk.Kind == "StatefulSet":
+		return replicasHealth(obj, "readyReplicas")
+	case gvk.Group == "apps" && gvk.Kind == "ReplicaSet":
+		return replicasHealth(obj, "availableReplicas")
+	case gvk.Group == "apps" && gvk.Kind == "DaemonSet":
+		return daemonSetHealth(obj)
+	case gvk.Group == "batch" && gvk.Kind == "Job":
+		return jobHealth(obj)
+	case gvk.Group == "" && gvk.Kind == "Pod":
+		return podHealth(obj)
+	case gvk.Group == "" && gvk.Kind == "PersistentVolumeClaim":
+		return pvcHealth(obj)
+	}
+	return argoprojiov1alpha1.ResourceHealthy
+}
+
+func deploymentHealth(obj *unstructured.Unstructured) argoprojiov1alpha1.ResourceHealth {
+	if isProgressing(obj) {
+		return argoprojiov1alpha1.ResourceProgressing
+	}
+	if c := findCondition(obj, "Progressing"); c != nil && c["reason"] == "ProgressDeadlineExceeded" {
+		return argoprojiov1alpha1.ResourceDegraded
+	}
+
+	replicas := desiredReplicas(obj)
+	updated, _, _ := unstructured.NestedInt64(obj.Object, "status", "updatedReplicas")
+	available, _, _ := unstructured.NestedInt64(obj.Object, "status", "availableReplicas")
+	if updated < replicas || available < updated {
+		return argoprojiov1alpha1.ResourceProgressing
+	}
+	return argoprojiov1alpha1.ResourceHealthy
+}
+
+func replicasHealth(obj *unstructured.Unstructured, readyField string) argoprojiov1alpha1.ResourceHealth {
+	if isProgressing(obj) {
+		return argoprojiov1alpha1.ResourceProgressing
+	}
+	ready, _, _ := unstructured.NestedInt64(obj.Object, "status", readyField)
+	if ready < desiredReplicas(obj) {
+		return argoprojiov1alpha1.ResourceProgressing
+	}
+	return argoprojiov1alpha1.ResourceHealthy
+}
+
+func daemonSetHealth(obj *unstructured.Unstructured) argoprojiov1alpha1.ResourceHealth {
+	if isProgressing(obj) {
+		return argoprojiov1alpha1.ResourceProgressing
+	}
+	desired, _, _ := unstructured.NestedInt64(obj.Object, "status", "desiredNumberScheduled")
+	available, _, _ := unstructured.NestedInt64(obj.Object, "status", "numberAvailable")
+	if available < desired {
+		return argoprojiov1alpha1.ResourceProgressing
+	}
+	return argoprojiov1alpha1.ResourceHealthy
+}
+
+func jobHealth(obj *unstructured.Unstructured) argoprojiov1alpha1.ResourceHealth {
+	if c := findCondition(obj, "Failed"); c != nil && c["status"] == "True" {
+		return argoprojiov1alpha1.ResourceDegraded
+	}
+	if c := findCondition(obj, "Complete"); c != nil && c["status"] == "True" {
+		return argoprojiov1alpha1.ResourceHealthy
+	}
+	return argoprojiov1alpha1.ResourceProgressing
+}
+
+func podHealth(obj *unstructured.Unstructured) argoprojiov1alpha1.ResourceHealth {
+	phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+	switch phase {
+	case "Succeeded":
+		return argoprojiov1alpha1.ResourceHealthy
+	case "Failed":
+		return argoprojiov1alpha1.ResourceDegraded
+	case "Running":
+		if c := findCondition(obj, "Ready"); c != nil && c["status"] == "True" {
+			return argoprojiov1alpha1.ResourceHealthy
+		}
+	}
+	return argoprojiov1alpha1.ResourceProgressing
+}
+
+func pvcHealth(obj *unstructured.Unstructured) argoprojiov1alpha1.ResourceHealth {
+	phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+	switch phase {
+	case "Bound":
+		return argoprojiov1alpha1.ResourceHealthy
+	case "Lost":
+		return argoprojiov1alpha1.ResourceDegraded
+	}
+	return argoprojiov1alpha1.ResourceProgressing
+}
+
+// isProgressing tells whether the controller of obj hasn't observed its latest
+// spec yet.
+func isProgressing(obj *unstructured.Unstructured) bool {
+	observed, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	return observed < obj.GetGeneration()
+}
+
+// desiredReplicas returns spec.replicas, which defaults to 1.
+func desiredReplicas(obj *unstructured.Unstructured) int64 {
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found {
+		return 1
+	}
+	return replicas
+}
+
+// findCondition returns the status condition of obj with the given type.
+func findCondition(obj *unstructured.Unstructured, conditionType string) map[string]interface{} {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == conditionType {
+			return condition
+		}
+	}
+	return nil
+}
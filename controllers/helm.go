@@ -0,0 +1,437 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/repo"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+const (
+	// maxChartSize is the total size of the files of a chart, packaged or
+	// not, so that a single chart can't exhaust the memory of the controller.
+	maxChartSize = 64 << 20
+	// maxIndexSize is the size of the largest chart repository index read.
+	maxIndexSize = 32 << 20
+	// maxValuesSize is the size of the largest values file read. Values from
+	// ConfigMaps and Secrets are limited to about as much by etcd.
+	maxValuesSize = 1 << 20
+	// chartFetchTimeout bounds the download of an index or a chart.
+	chartFetchTimeout = 2 * time.Minute
+	// defaultValuesKey is the key values are read from in the ConfigMaps and
+	// Secrets of spec.helm.valuesFrom.
+	defaultValuesKey = "values.yaml"
+	// notesSuffix ends the name of the templates rendering the release notes,
+	// which aren't manifests.
+	notesSuffix = "NOTES.txt"
+)
+
+// chartClient downloads chart repository indexes and charts.
+var chartClient = &http.Client{Timeout: chartFetchTimeout}
+
+// helmRelease is the release a chart is rendered for.
+type helmRelease struct {
+	name      string
+	namespace string
+	// values override the values files of the chart, later ones the earlier
+	// ones: those of spec.helm.valuesFrom, then spec.helm.values.
+	values []map[string]interface{}
+}
+
+// isChartRepository tells whether the chart of app is fetched from the chart
+// repository at spec.repoURL rather than checked out from Git.
+func isChartRepository(app *argoprojiov1alpha1.MicroApplication) bool {
+	return app.Spec.Helm != nil && app.Spec.Helm.Chart != ""
+}
+
+// helmRelease returns the release the chart of app is rendered for, reading
+// spec.helm.valuesFrom on behalf of creator, with c when it impersonates
+// creator.
+func (r *MicroApplicationReconciler) helmRelease(ctx context.Context, c client.Client, app *argoprojiov1alpha1.MicroApplication, creator authenticationv1.UserInfo) (*helmRelease, error) {
+	opts := app.Spec.Helm
+	release := &helmRelease{name: opts.ReleaseName, namespace: destinationNamespace(app)}
+	if release.name == "" {
+		release.name = app.Name
+	}
+
+	for _, from := range opts.ValuesFrom {
+		key := from.Key
+		if key == "" {
+			key = defaultValuesKey
+		}
+		ref := argoprojiov1alpha1.ResourceRef{Version: "v1", Kind: from.Kind, Namespace: app.Namespace, Name: from.Name}
+		var data []byte
+		var found bool
+		switch from.Kind {
+		case "ConfigMap":
+			configMap := &corev1.ConfigMap{}
+			if err := r.getAsCreator(ctx, c, creator, ref, configMap); err != nil {
+				return nil, err
+			}
+			var value string
+			value, found = configMap.Data[key]
+			data = []byte(value)
+		case "Secret":
+			secret := &corev1.Secret{}
+			if err := r.getAsCreator(ctx, c, creator, ref, secret); err != nil {
+				return nil, err
+			}
+			data, found = secret.Data[key]
+		default:
+			return nil, fmt.Errorf("values can't be read from a %s", from.Kind)
+		}
+		if !found {
+			return nil, fmt.Errorf("%s %s/%s has no %s", from.Kind, ref.Namespace, ref.Name, key)
+		}
+		values, err := chartutil.ReadValues(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s of %s %s/%s: %v", key, from.Kind, ref.Namespace, ref.Name, err)
+		}
+		release.values = append(release.values, values.AsMap())
+	}
+
+	values, err := chartutil.ReadValues([]byte(opts.Values))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse spec.helm.values: %v", err)
+	}
+	release.values = append(release.values, values.AsMap())
+	return release, nil
+}
+
+// fetchChart downloads the chart name from the chart repository at repoURL,
+// in the latest version matching the semver range version, or in the latest
+// stable version when version is empty. Basic auth credentials in auth are
+// only sent to the host of repoURL.
+func fetchChart(ctx context.Context, repoURL string, name string, version string, auth transport.AuthMethod) (*chart.Chart, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	basicAuth, _ := auth.(*githttp.BasicAuth)
+
+	data, err := download(ctx, strings.TrimSuffix(repoURL, "/")+"/index.yaml", u.Host, basicAuth, maxIndexSize)
+	if err != nil {
+		return nil, err
+	}
+	index := &repo.IndexFile{}
+	if err := yaml.UnmarshalStrict(data, index); err != nil {
+		return nil, fmt.Errorf("unable to parse the index of %s: %v", repoURL, err)
+	}
+	if index.APIVersion == "" {
+		return nil, fmt.Errorf("unable to parse the index of %s: %v", repoURL, repo.ErrNoAPIVersion)
+	}
+	index.SortEntries()
+
+	chartVersion, err := index.Get(name, version)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find chart %s %s in %s: %v", name, version, repoURL, err)
+	}
+	if len(chartVersion.URLs) == 0 {
+		return nil, fmt.Errorf("chart %s %s has no URL in %s", name, chartVersion.Version, repoURL)
+	}
+	chartURL, err := repo.ResolveReferenceURL(repoURL, chartVersion.URLs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = download(ctx, chartURL, u.Host, basicAuth, maxChartSize)
+	if err != nil {
+		return nil, err
+	}
+	if chartVersion.Digest != "" {
+		digest := sha256.Sum256(data)
+		if hex.EncodeToString(digest[:]) != chartVersion.Digest {
+			return nil, fmt.Errorf("chart %s %s doesn't match its digest in the index of %s", name, chartVersion.Version, repoURL)
+		}
+	}
+	if err := checkArchiveSize(data); err != nil {
+		return nil, fmt.Errorf("chart %s %s: %v", name, chartVersion.Version, err)
+	}
+	return loader.LoadArchive(bytes.NewReader(data))
+}
+
+// download reads at most limit bytes from rawURL, with the credentials in
+// auth if rawURL is on host.
+func download(ctx context.Context, rawURL string, host string, auth *githttp.BasicAuth, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Charts may be served from another host than the index, which has no
+	// business with the credentials of the repository.
+	if auth != nil && req.URL.Host == host {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := chartClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download %s: %s", rawURL, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d MiB", rawURL, limit>>20)
+	}
+	return data, nil
+}
+
+// checkArchiveSize fails if the packaged chart in data holds more than
+// maxChartSize bytes once decompressed, before the loader decompresses it in
+// memory.
+func checkArchiveSize(data []byte) error {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(r, maxChartSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxChartSize {
+		return fmt.Errorf("chart holds more than %d MiB", maxChartSize>>20)
+	}
+	return nil
+}
+
+// renderGitChart renders the chart at path, relative to the clone at
+// repoPath, for release, with the values files valueFiles of the clone.
+func renderGitChart(repoPath string, path string, valueFiles []string, release *helmRelease) ([]*unstructured.Unstructured, error) {
+	root, err := filepath.EvalSymlinks(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := resolveInRepository(root, path)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := loadChartDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []map[string]interface{}
+	for _, file := range valueFiles {
+		v, err := readValuesFile(root, file)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return renderChart(ch, release, values)
+}
+
+// resolveInRepository resolves the symbolic links leading to path, relative
+// to the repository at root, and fails if it ends up outside of it.
+func resolveInRepository(root string, path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		return "", err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is outside of the repository", path)
+	}
+	return resolved, nil
+}
+
+// loadChartDir loads the chart in dir. The loader follows symbolic links,
+// which could point to files outside of the repository, so that charts
+// holding any are rejected.
+func loadChartDir(dir string) (*chart.Chart, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			rel, _ := filepath.Rel(dir, path)
+			return fmt.Errorf("chart holds the symbolic link %s, which is not supported", rel)
+		}
+		total += info.Size()
+		if total > maxChartSize {
+			return fmt.Errorf("chart holds more than %d MiB", maxChartSize>>20)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loader.LoadDir(dir)
+}
+
+// readValuesFile reads the values file at path, relative to the repository at
+// root, which has to be a regular file of the repository.
+func readValuesFile(root string, path string) (map[string]interface{}, error) {
+	resolved, err := resolveInRepository(root, path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("values file %q is not a regular file", path)
+	}
+	if info.Size() > maxValuesSize {
+		return nil, fmt.Errorf("values file %q is larger than %d MiB", path, maxValuesSize>>20)
+	}
+	data, err := ioutil.ReadFile(resolved)
+	if err != nil {
+		return nil, err
+	}
+	values, err := chartutil.ReadValues(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse values file %q: %v", path, err)
+	}
+	return values.AsMap(), nil
+}
+
+// renderChart renders ch for release the way helm template does, with
+// valueFiles, then the values of release, overriding the values of the chart.
+// Hooks aren't part of the result, since they aren't run, and templates are
+// rendered against the default capabilities of Helm, without access to the
+// cluster.
+func renderChart(ch *chart.Chart, release *helmRelease, valueFiles []map[string]interface{}) ([]*unstructured.Unstructured, error) {
+	if ch.Metadata.Type == "library" {
+		return nil, fmt.Errorf("chart %s is a library chart, which can't be installed", ch.Name())
+	}
+	if err := checkDependencies(ch); err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	for _, v := range append(valueFiles, release.values...) {
+		values = mergeValues(values, v)
+	}
+	if err := chartutil.ProcessDependencies(ch, values); err != nil {
+		return nil, err
+	}
+	options := chartutil.ReleaseOptions{
+		Name:      release.name,
+		Namespace: release.namespace,
+		Revision:  1,
+		IsInstall: true,
+	}
+	renderValues, err := chartutil.ToRenderValues(ch, values, options, chartutil.DefaultCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	files, err := engine.Render(ch, renderValues)
+	if err != nil {
+		return nil, err
+	}
+	for name := range files {
+		if strings.HasSuffix(name, notesSuffix) {
+			delete(files, name)
+		}
+	}
+	_, manifests, err := releaseutil.SortManifests(files, chartutil.DefaultCapabilities.APIVersions, releaseutil.InstallOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*unstructured.Unstructured
+	for _, crd := range ch.CRDObjects() {
+		items, err := SplitYAML(crd.File.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", crd.Filename, err)
+		}
+		res = append(res, items...)
+	}
+	for _, manifest := range manifests {
+		items, err := SplitYAML([]byte(manifest.Content))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", manifest.Name, err)
+		}
+		res = append(res, items...)
+	}
+	return res, nil
+}
+
+// checkDependencies fails if a dependency listed in Chart.yaml is missing
+// from the charts directory of ch, which Helm leaves to helm dependency
+// build.
+func checkDependencies(ch *chart.Chart) error {
+	var missing []string
+	for _, dependency := range ch.Metadata.Dependencies {
+		found := false
+		for _, c := range ch.Dependencies() {
+			found = found || c.Name() == dependency.Name
+		}
+		if !found {
+			missing = append(missing, dependency.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("chart %s lacks its dependencies %s in its charts directory", ch.Name(), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// mergeValues returns base with override merged into it, merging maps
+// recursively the way Helm merges values files.
+func mergeValues(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		if overrideMap, ok := value.(map[string]interface{}); ok {
+			if baseMap, ok := merged[key].(map[string]interface{}); ok {
+				merged[key] = mergeValues(baseMap, overrideMap)
+				continue
+			}
+		}
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,461 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// testChart returns the files of a chart rendering a ConfigMap from its
+// values, along with release notes, a hook and a CRD.
+func testChart(version string) map[string]string {
+	return map[string]string{
+		"Chart.yaml": fmt.Sprintf("apiVersion: v2\nname: demo\nversion: %s\n", version),
+		"values.yaml": `replicas: 1
+image:
+  repository: nginx
+  tag: "1.0"
+`,
+		"templates/configmap.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-config
+  namespace: {{ .Release.Namespace }}
+data:
+  version: {{ .Chart.Version | quote }}
+  replicas: {{ .Values.replicas | quote }}
+  image: "{{ .Values.image.repository }}:{{ .Values.image.tag }}"
+`,
+		"templates/hook.yaml": `apiVersion: v1
+kind: Pod
+metadata:
+  name: {{ .Release.Name }}-test
+  annotations:
+    helm.sh/hook: test
+`,
+		"templates/NOTES.txt": "Installed {{ .Release.Name }}.\n",
+		"crds/crd.yaml": `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: demos.example.com
+`,
+	}
+}
+
+// packageChart packages files the way helm package does, below a directory
+// named after the chart.
+func packageChart(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: "demo/" + name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// configMapData returns the data of the ConfigMap named name in res.
+func configMapData(res []*unstructured.Unstructured, name string) map[string]string {
+	for _, u := range res {
+		if u.GetKind() == "ConfigMap" && u.GetName() == name {
+			data, _, _ := unstructured.NestedStringMap(u.Object, "data")
+			return data
+		}
+	}
+	return nil
+}
+
+func kindsOf(res []*unstructured.Unstructured) []string {
+	var kinds []string
+	for _, u := range res {
+		kinds = append(kinds, u.GetKind())
+	}
+	return kinds
+}
+
+func TestFetchChart(t *testing.T) {
+	charts := map[string][]byte{}
+	for _, version := range []string{"1.0.0", "1.1.0", "2.0.0-rc.1"} {
+		charts["/charts/demo-"+version+".tgz"] = packageChart(t, testChart(version))
+	}
+	digest := func(path string) string {
+		sum := sha256.Sum256(charts[path])
+		return hex.EncodeToString(sum[:])
+	}
+
+	// Serves the chart the index of the repository points to on another host.
+	var otherFetched, otherAuthorized bool
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		otherFetched = true
+		_, _, otherAuthorized = req.BasicAuth()
+		w.Write(charts["/charts/demo-1.0.0.tgz"])
+	}))
+	defer other.Close()
+
+	index := fmt.Sprintf(`apiVersion: v1
+entries:
+  demo:
+  - name: demo
+    version: 1.0.0
+    urls: [charts/demo-1.0.0.tgz]
+    digest: %s
+  - name: demo
+    version: 2.0.0-rc.1
+    urls: [charts/demo-2.0.0-rc.1.tgz]
+  - name: demo
+    version: 1.1.0
+    urls: [/charts/demo-1.1.0.tgz]
+  tampered:
+  - name: demo
+    version: 1.1.0
+    urls: [charts/demo-1.1.0.tgz]
+    digest: %s
+  elsewhere:
+  - name: demo
+    version: 1.0.0
+    urls: [%s/demo-1.0.0.tgz]
+`, digest("/charts/demo-1.0.0.tgz"), digest("/charts/demo-1.0.0.tgz"), other.URL)
+	repository := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if username, password, _ := req.BasicAuth(); username != "reader" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path == "/index.yaml" {
+			w.Write([]byte(index))
+			return
+		}
+		chart, ok := charts[req.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(chart)
+	}))
+	defer repository.Close()
+	auth := &githttp.BasicAuth{Username: "reader", Password: "secret"}
+
+	tests := []struct {
+		name    string
+		chart   string
+		version string
+		auth    *githttp.BasicAuth
+		want    string
+		wantErr bool
+	}{
+		{name: "latest stable version", chart: "demo", auth: auth, want: "1.1.0"},
+		{name: "range", chart: "demo", version: "~1.0", auth: auth, want: "1.0.0"},
+		{name: "exact version", chart: "demo", version: "2.0.0-rc.1", auth: auth, want: "2.0.0-rc.1"},
+		{name: "no matching version", chart: "demo", version: "3.x", auth: auth, wantErr: true},
+		{name: "unknown chart", chart: "missing", auth: auth, wantErr: true},
+		{name: "digest mismatch", chart: "tampered", auth: auth, wantErr: true},
+		{name: "no credentials", chart: "demo", wantErr: true},
+		{name: "chart on another host", chart: "elsewhere", auth: auth, want: "1.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, err := fetchChart(context.Background(), repository.URL+"/", tt.chart, tt.version, tt.auth)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("fetched %s %s", ch.Name(), ch.Metadata.Version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ch.Metadata.Version != tt.want {
+				t.Errorf("fetched version %s, want %s", ch.Metadata.Version, tt.want)
+			}
+		})
+	}
+	if !otherFetched {
+		t.Error("the chart on another host wasn't fetched from there")
+	}
+	if otherAuthorized {
+		t.Error("the credentials of the repository were sent to another host")
+	}
+}
+
+func TestRenderChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, testChart("1.0.0"))
+	ch, err := loadChartDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := &helmRelease{
+		name:      "prod",
+		namespace: "team-a",
+		values: []map[string]interface{}{
+			{"replicas": 2, "image": map[string]interface{}{"tag": "2.0"}},
+			{"replicas": 3},
+		},
+	}
+	valueFiles := []map[string]interface{}{
+		{"image": map[string]interface{}{"repository": "registry.example.com/nginx", "tag": "1.5"}},
+	}
+	res, err := renderChart(ch, release, valueFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kinds, want := kindsOf(res), []string{"CustomResourceDefinition", "ConfigMap"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("rendered %v, want %v: release notes and hooks are left out", kinds, want)
+	}
+	want := map[string]string{"version": "1.0.0", "replicas": "3", "image": "registry.example.com/nginx:2.0"}
+	if data := configMapData(res, "prod-config"); !reflect.DeepEqual(data, want) {
+		t.Errorf("rendered data %v, want %v", data, want)
+	}
+	for _, u := range res {
+		if u.GetKind() == "ConfigMap" && u.GetNamespace() != "team-a" {
+			t.Errorf("rendered in namespace %q, want the release namespace", u.GetNamespace())
+		}
+	}
+
+	library, err := loadChartDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	library.Metadata.Type = "library"
+	if _, err := renderChart(library, release, nil); err == nil {
+		t.Error("rendered a library chart")
+	}
+}
+
+func TestRenderGitChart(t *testing.T) {
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	writeFiles(t, outside, map[string]string{"values.yaml": "replicas: 5\n"})
+
+	repoPath, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoPath)
+	for name, content := range testChart("1.0.0") {
+		writeFiles(t, repoPath, map[string]string{filepath.Join("chart", name): content})
+	}
+	writeFiles(t, repoPath, map[string]string{
+		"envs/prod.yaml":    "replicas: 2\n",
+		"linked/Chart.yaml": "apiVersion: v2\nname: linked\nversion: 1.0.0\n",
+	})
+	for link, target := range map[string]string{
+		"envs/outside.yaml":         filepath.Join(outside, "values.yaml"),
+		"envs/linked.yaml":          "prod.yaml",
+		"linked/templates":          filepath.Join(outside),
+		"outside-chart":             outside,
+		"envs/directory-values.yml": ".",
+	} {
+		if err := os.Symlink(target, filepath.Join(repoPath, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release := &helmRelease{name: "prod", namespace: "team-a"}
+
+	tests := []struct {
+		name         string
+		path         string
+		valueFiles   []string
+		wantReplicas string
+		wantErr      bool
+	}{
+		{name: "chart", path: "chart", wantReplicas: "1"},
+		{name: "value file", path: "chart", valueFiles: []string{"envs/prod.yaml"}, wantReplicas: "2"},
+		{name: "value file linked within the repository", path: "chart", valueFiles: []string{"envs/linked.yaml"}, wantReplicas: "2"},
+		{name: "value file outside of the repository", path: "chart", valueFiles: []string{"envs/outside.yaml"}, wantErr: true},
+		{name: "directory as value file", path: "chart", valueFiles: []string{"envs/directory-values.yml"}, wantErr: true},
+		{name: "missing value file", path: "chart", valueFiles: []string{"envs/staging.yaml"}, wantErr: true},
+		{name: "chart holding a symbolic link", path: "linked", wantErr: true},
+		{name: "chart outside of the repository", path: "outside-chart", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := renderGitChart(repoPath, tt.path, tt.valueFiles, release)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("rendered %v", kindsOf(res))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replicas := configMapData(res, "prod-config")["replicas"]; replicas != tt.wantReplicas {
+				t.Errorf("rendered %s replicas, want %s", replicas, tt.wantReplicas)
+			}
+		})
+	}
+}
+
+func TestHelmRelease(t *testing.T) {
+	objects := []runtime.Object{
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "defaults"},
+			Data:       map[string]string{"values.yaml": "replicas: 2\nimage:\n  tag: \"1.5\"\n"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "prod"},
+			Data:       map[string][]byte{"prod.yaml": []byte("image:\n  tag: \"2.0\"\n")},
+		},
+	}
+	r := &MicroApplicationReconciler{apiReader: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithRuntimeObjects(objects...).Build()}
+
+	tests := []struct {
+		name    string
+		opts    argoprojiov1alpha1.HelmOptions
+		want    *helmRelease
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: &helmRelease{name: "app", namespace: "team-a", values: []map[string]interface{}{{}}},
+		},
+		{
+			name: "values",
+			opts: argoprojiov1alpha1.HelmOptions{
+				ReleaseName: "app-prod",
+				ValuesFrom: []argoprojiov1alpha1.HelmValuesReference{
+					{Kind: "ConfigMap", Name: "defaults"},
+					{Kind: "Secret", Name: "prod", Key: "prod.yaml"},
+				},
+				Values: "replicas: 3\n",
+			},
+			want: &helmRelease{name: "app-prod", namespace: "team-a", values: []map[string]interface{}{
+				{"replicas": float64(2), "image": map[string]interface{}{"tag": "1.5"}},
+				{"image": map[string]interface{}{"tag": "2.0"}},
+				{"replicas": float64(3)},
+			}},
+		},
+		{
+			name:    "missing key",
+			opts:    argoprojiov1alpha1.HelmOptions{ValuesFrom: []argoprojiov1alpha1.HelmValuesReference{{Kind: "Secret", Name: "prod"}}},
+			wantErr: true,
+		},
+		{
+			name:    "missing ConfigMap",
+			opts:    argoprojiov1alpha1.HelmOptions{ValuesFrom: []argoprojiov1alpha1.HelmValuesReference{{Kind: "ConfigMap", Name: "staging"}}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid values",
+			opts:    argoprojiov1alpha1.HelmOptions{Values: "- replicas"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &argoprojiov1alpha1.MicroApplication{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"},
+				Spec:       argoprojiov1alpha1.MicroApplicationSpec{Helm: &tt.opts},
+			}
+			release, err := r.helmRelease(context.Background(), nil, app, authenticationv1.UserInfo{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("read values %v", release.values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(release, tt.want) {
+				t.Errorf("got %+v, want %+v", release, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeValues(t *testing.T) {
+	base := map[string]interface{}{
+		"replicas": 1,
+		"image":    map[string]interface{}{"repository": "nginx", "tag": "1.0"},
+		"ports":    []interface{}{80},
+	}
+	override := map[string]interface{}{
+		"image": map[string]interface{}{"tag": "2.0"},
+		"ports": []interface{}{8080},
+		"debug": true,
+	}
+	want := map[string]interface{}{
+		"replicas": 1,
+		"image":    map[string]interface{}{"repository": "nginx", "tag": "2.0"},
+		"ports":    []interface{}{8080},
+		"debug":    true,
+	}
+	if merged := mergeValues(base, override); !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged %v, want %v", merged, want)
+	}
+	if tag := base["image"].(map[string]interface{})["tag"]; tag != "1.0" {
+		t.Errorf("base was modified, image.tag = %v", tag)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// ApplyMode selects how the controller makes sure creators only sync
+// resources they could manage on their own.
+type ApplyMode string
+
+const (
+	// ApplyModeSubjectAccessReview checks every resource with a
+	// SubjectAccessReview for the creator, then applies it with the identity
+	// of the controller.
+	ApplyModeSubjectAccessReview ApplyMode = "sar"
+	// ApplyModeImpersonate reads and writes every resource impersonating the
+	// creator, so that the API server enforces their permissions itself.
+	ApplyModeImpersonate ApplyMode = "impersonate"
+)
+
+// creatorOf returns the identity of the creator of app, as recorded by the
+// mutating webhook. Applications created before spec.creator was recorded
+// fall back to the name in the creator annotation, without any groups. Without
+// the webhook, anybody could record any creator: every application is then
+// creator-less.
+func (r *MicroApplicationReconciler) creatorOf(app *argoprojiov1alpha1.MicroApplication) authenticationv1.UserInfo {
+	if r.WebhooksDisabled {
+		return authenticationv1.UserInfo{}
+	}
+	if app.Spec.Creator != nil {
+		return *app.Spec.Creator
+	}
+	return authenticationv1.UserInfo{Username: app.Annotations[argoprojiov1alpha1.CreatorAnnotation]}
+}
+
+// impersonates tells whether the resources synced on behalf of creator are
+// read and written as creator.
+func (r *MicroApplicationReconciler) impersonates(creator authenticationv1.UserInfo) bool {
+	return r.ApplyMode == ApplyModeImpersonate && r.requiresPermissionChecks(creator)
+}
+
+// checksPermissions tells whether the resources synced on behalf of creator
+// go through a SubjectAccessReview before the controller touches them.
+func (r *MicroApplicationReconciler) checksPermissions(creator authenticationv1.UserInfo) bool {
+	return r.ApplyMode != ApplyModeImpersonate && r.requiresPermissionChecks(creator)
+}
+
+// clientFor returns the client the resources of an application are read and
+// written with: one impersonating creator in impersonate mode, the
+// controller's own otherwise. The UID of creator isn't impersonated, since
+// the API server only supports impersonating UIDs as of Kubernetes 1.22.
+func (r *MicroApplicationReconciler) clientFor(creator authenticationv1.UserInfo) (client.Client, error) {
+	if !r.impersonates(creator) {
+		return r.Client, nil
+	}
+	config := rest.CopyConfig(r.config)
+	config.Impersonate = rest.ImpersonationConfig{
+		UserName: creator.Username,
+		Groups:   creator.Groups,
+	}
+	if len(creator.Extra) > 0 {
+		config.Impersonate.Extra = map[string][]string{}
+		for key, values := range creator.Extra {
+			config.Impersonate.Extra[key] = values
+		}
+	}
+	return client.New(config, client.Options{Scheme: r.Scheme, Mapper: r.mapper})
+}
@@ -0,0 +1,404 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kubeyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	kustomizetypes "sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/yaml"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+const (
+	// kustomizeRepoRoot is where the clone is copied to in the in-memory file
+	// system kustomize runs against.
+	kustomizeRepoRoot = "/repo"
+	// kustomizeOverlayRoot is where the kustomization carrying the overrides
+	// from spec.kustomize is written to.
+	kustomizeOverlayRoot = "/overlay"
+	// maxKustomizeFileSize is the size of the largest file copied to the
+	// in-memory file system. Larger files can't end up in a resource anyway,
+	// objects are limited to about as much by etcd.
+	maxKustomizeFileSize = 1 << 20
+	// maxKustomizeCopySize is the total size of the files copied to the
+	// in-memory file system, so that a single repository can't exhaust the
+	// memory of the controller.
+	maxKustomizeCopySize = 64 << 20
+)
+
+// isKustomization tells whether dir holds a kustomization file.
+func isKustomization(dir string) bool {
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// renderKustomization builds path, relative to the clone at repoPath, with
+// kustomize and applies the overrides from opts on top of it. When path holds
+// no kustomization file, every manifest below it is used as a resource.
+//
+// Kustomize runs against an in-memory copy of the clone, so that bases can't
+// reach files outside of the repository, such as the clones of other
+// MicroApplications, and kustomizations referencing anything outside of the
+// repository are rejected.
+func renderKustomization(repoPath string, path string, opts *argoprojiov1alpha1.KustomizeOptions) ([]*unstructured.Unstructured, error) {
+	fSys := filesys.MakeFsInMemory()
+	if err := copyToFs(repoPath, kustomizeRepoRoot, fSys); err != nil {
+		return nil, err
+	}
+
+	target := filepath.Join(kustomizeRepoRoot, path)
+	if !strings.HasPrefix(target, kustomizeRepoRoot+"/") && target != kustomizeRepoRoot {
+		return nil, fmt.Errorf("path %q is outside of the repository", path)
+	}
+	if !isKustomizationFs(fSys, target) {
+		if err := writeGeneratedKustomization(fSys, target); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := rejectRemoteReferences(fSys, kustomizeRepoRoot); err != nil {
+		return nil, err
+	}
+
+	if opts != nil {
+		if err := writeOverlay(fSys, target, opts); err != nil {
+			return nil, err
+		}
+		target = kustomizeOverlayRoot
+	}
+
+	resMap, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(fSys, target)
+	if err != nil {
+		return nil, err
+	}
+	data, err := resMap.AsYaml()
+	if err != nil {
+		return nil, err
+	}
+	return SplitYAML(data)
+}
+
+// copyToFs copies the files below src on disk to dst in fSys, leaving out the
+// .git directory and files larger than maxKustomizeFileSize. It fails once
+// more than maxKustomizeCopySize bytes were copied.
+func copyToFs(src string, dst string, fSys filesys.FileSystem) error {
+	var total int64
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return fSys.MkdirAll(filepath.Join(dst, rel))
+		}
+		if !info.Mode().IsRegular() || info.Size() > maxKustomizeFileSize {
+			return nil
+		}
+		total += info.Size()
+		if total > maxKustomizeCopySize {
+			return fmt.Errorf("repository holds more than %d MiB of files to build", maxKustomizeCopySize>>20)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return fSys.WriteFile(filepath.Join(dst, rel), data)
+	})
+}
+
+// rejectRemoteReferences rejects the kustomizations and builtin plugin
+// configurations below root in fSys which reference anything but files of the
+// repository. Kustomize would otherwise fetch http(s) URLs and clone Git
+// repositories from within the cluster network, regardless of the allowed
+// repository URL schemes and of the source repositories of projects.
+func rejectRemoteReferences(fSys filesys.FileSystem, root string) error {
+	return fSys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		isKustomization := false
+		for _, kustomizationName := range konfig.RecognizedKustomizationFileNames() {
+			isKustomization = isKustomization || filepath.Base(path) == kustomizationName
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !isKustomization && ext != ".json" && ext != ".yml" && ext != ".yaml" {
+			return nil
+		}
+
+		data, err := fSys.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if isKustomization {
+			return checkKustomizationReferences(name, data)
+		}
+		return checkPluginReferences(name, data)
+	})
+}
+
+// checkKustomizationReferences rejects the kustomization in data, read from
+// the file name, if it references anything but files of the repository.
+func checkKustomizationReferences(name string, data []byte) error {
+	k := &kustomizetypes.Kustomization{}
+	if err := yaml.Unmarshal(data, k); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", name, err)
+	}
+
+	// These are loaded as files or directories, which may also be Git
+	// repositories.
+	var bases []string
+	bases = append(bases, k.Resources...)
+	bases = append(bases, k.Bases...)
+	bases = append(bases, k.Components...)
+	for _, plugins := range [][]string{k.Generators, k.Transformers, k.Validators} {
+		for _, plugin := range plugins {
+			// Plugins may be configured inline.
+			if err := checkPluginReferences(name, []byte(plugin)); err != nil {
+				return err
+			}
+			bases = append(bases, plugin)
+		}
+	}
+	for _, base := range bases {
+		if isRemoteBase(base) {
+			return remoteReferenceError(name, base)
+		}
+	}
+
+	// These are only loaded as files.
+	var files []string
+	files = append(files, k.Crds...)
+	files = append(files, k.Configurations...)
+	files = append(files, k.OpenAPI["path"])
+	for _, patch := range k.PatchesStrategicMerge {
+		files = append(files, string(patch))
+	}
+	for _, patch := range k.Patches {
+		files = append(files, patch.Path)
+	}
+	for _, patch := range k.PatchesJson6902 {
+		files = append(files, patch.Path)
+	}
+	for _, generator := range k.ConfigMapGenerator {
+		files = append(files, generatorFiles(generator.KvPairSources)...)
+	}
+	for _, generator := range k.SecretGenerator {
+		files = append(files, generatorFiles(generator.KvPairSources)...)
+	}
+	for _, file := range files {
+		if isRemoteFile(file) {
+			return remoteReferenceError(name, file)
+		}
+	}
+	return nil
+}
+
+// checkPluginReferences rejects the builtin plugin configurations in data, read
+// from the file name, which reference anything but files of the repository.
+// Anything else in data is left alone.
+func checkPluginReferences(name string, data []byte) error {
+	r := kubeyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		doc, err := r.Read()
+		if err != nil {
+			// Either the end of data, or data isn't YAML.
+			return nil
+		}
+		config := map[string]interface{}{}
+		if err := yaml.Unmarshal(doc, &config); err != nil {
+			// kustomize doesn't load it as a plugin configuration either.
+			continue
+		}
+		if config["apiVersion"] != konfig.BuiltinPluginApiVersion {
+			continue
+		}
+		if kind := config["kind"]; kind == "HelmChartInflationGenerator" {
+			return fmt.Errorf("%s: %s fetches charts from outside of the repository and is not supported", name, kind)
+		}
+
+		sources := kustomizetypes.KvPairSources{}
+		sources.EnvSource, _ = config["env"].(string)
+		sources.EnvSources = stringValues(config["envs"])
+		sources.FileSources = stringValues(config["files"])
+		files := generatorFiles(sources)
+		files = append(files, stringValues(config["paths"])...)
+		for _, field := range []string{"path", "targetFilePath"} {
+			if file, ok := config[field].(string); ok {
+				files = append(files, file)
+			}
+		}
+		for _, file := range files {
+			if isRemoteFile(file) {
+				return remoteReferenceError(name, file)
+			}
+		}
+	}
+}
+
+// generatorFiles returns the files the data of a generated ConfigMap or Secret
+// is read from.
+func generatorFiles(sources kustomizetypes.KvPairSources) []string {
+	files := append([]string{sources.EnvSource}, sources.EnvSources...)
+	for _, source := range sources.FileSources {
+		// Sources are either paths or key=path.
+		files = append(files, source, source[strings.Index(source, "=")+1:])
+	}
+	return files
+}
+
+func stringValues(value interface{}) []string {
+	values, _ := value.([]interface{})
+	var strs []string
+	for _, v := range values {
+		if str, ok := v.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// isRemoteFile tells whether kustomize would fetch ref, a reference to a file,
+// from a URL instead of reading it from the repository.
+func isRemoteFile(ref string) bool {
+	u, err := url.Parse(ref)
+	return err == nil && u.Scheme != ""
+}
+
+// isRemoteBase tells whether kustomize would clone ref, a reference to a file
+// or directory, from a Git repository, or fetch it from a URL, instead of
+// reading it from the repository. This follows the way kustomize recognizes
+// Git repositories, erring on the remote side.
+func isRemoteBase(ref string) bool {
+	if isRemoteFile(ref) || strings.Contains(ref, "_git/") {
+		return true
+	}
+	lower := strings.ToLower(ref)
+	for _, prefix := range []string{"git::", "gh:", "git@", "github.com"} {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteReferenceError(name string, ref string) error {
+	return fmt.Errorf("%s: %q is not a file of the repository, remote bases and resources are not supported", name, ref)
+}
+
+// isKustomizationFs tells whether dir in fSys holds a kustomization file.
+func isKustomizationFs(fSys filesys.FileSystem, dir string) bool {
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if fSys.Exists(filepath.Join(dir, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeGeneratedKustomization writes a kustomization to dir listing every
+// manifest below it, the same set of files parseManifests would pick up.
+func writeGeneratedKustomization(fSys filesys.FileSystem, dir string) error {
+	k := &kustomizetypes.Kustomization{}
+	err := walkFs(fSys, dir, func(path string) {
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".json" || ext == ".yml" || ext == ".yaml" {
+			rel, _ := filepath.Rel(dir, path)
+			k.Resources = append(k.Resources, rel)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return writeKustomization(fSys, dir, k)
+}
+
+// writeOverlay writes a kustomization to kustomizeOverlayRoot which applies
+// opts on top of the kustomization in base.
+func writeOverlay(fSys filesys.FileSystem, base string, opts *argoprojiov1alpha1.KustomizeOptions) error {
+	rel, err := filepath.Rel(kustomizeOverlayRoot, base)
+	if err != nil {
+		return err
+	}
+	k := &kustomizetypes.Kustomization{
+		Resources:         []string{rel},
+		NamePrefix:        opts.NamePrefix,
+		NameSuffix:        opts.NameSuffix,
+		CommonLabels:      opts.CommonLabels,
+		CommonAnnotations: opts.CommonAnnotations,
+	}
+	for _, image := range opts.Images {
+		k.Images = append(k.Images, kustomizetypes.Image{
+			Name:    image.Name,
+			NewName: image.NewName,
+			NewTag:  image.NewTag,
+			Digest:  image.Digest,
+		})
+	}
+	if err := fSys.MkdirAll(kustomizeOverlayRoot); err != nil {
+		return err
+	}
+	return writeKustomization(fSys, kustomizeOverlayRoot, k)
+}
+
+func writeKustomization(fSys filesys.FileSystem, dir string, k *kustomizetypes.Kustomization) error {
+	k.FixKustomizationPostUnmarshalling()
+	data, err := yaml.Marshal(k)
+	if err != nil {
+		return err
+	}
+	return fSys.WriteFile(filepath.Join(dir, konfig.DefaultKustomizationFileName()), data)
+}
+
+// walkFs calls fn for every file below dir in fSys, in lexical order.
+func walkFs(fSys filesys.FileSystem, dir string, fn func(path string)) error {
+	return fSys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			fn(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/filesys"
+)
+
+func TestRejectRemoteReferences(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		remote bool
+	}{
+		{
+			name:  "local resources and bases",
+			files: map[string]string{"app/kustomization.yaml": "resources:\n- cm.yaml\n- ../base\n"},
+		},
+		{
+			name:   "http resource",
+			files:  map[string]string{"app/kustomization.yaml": "resources:\n- http://169.254.169.254/latest/meta-data\n"},
+			remote: true,
+		},
+		{
+			name:   "github resource",
+			files:  map[string]string{"app/kustomization.yaml": "resources:\n- github.com/org/repo//deploy?ref=main\n"},
+			remote: true,
+		},
+		{
+			name:   "scp-like base",
+			files:  map[string]string{"app/kustomization.yaml": "bases:\n- git@github.com:org/repo.git\n"},
+			remote: true,
+		},
+		{
+			name:   "azure component",
+			files:  map[string]string{"app/kustomization.yaml": "components:\n- dev.azure.com/org/project/_git/repo\n"},
+			remote: true,
+		},
+		{
+			name:   "uppercase shorthand",
+			files:  map[string]string{"app/kustomization.yaml": "resources:\n- GH:org/repo\n"},
+			remote: true,
+		},
+		{
+			name:   "go-getter base",
+			files:  map[string]string{"app/kustomization.yaml": "resources:\n- git::https://internal/repo\n"},
+			remote: true,
+		},
+		{
+			name:   "remote patch",
+			files:  map[string]string{"app/kustomization.yaml": "patchesStrategicMerge:\n- https://internal/patch.yaml\n"},
+			remote: true,
+		},
+		{
+			name: "inline patch holding a URL",
+			files: map[string]string{"app/kustomization.yaml": `patchesStrategicMerge:
+- |
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: cm
+    annotations:
+      docs: https://example.com
+`},
+		},
+		{
+			name:   "remote json patch",
+			files:  map[string]string{"app/kustomization.yaml": "patches:\n- path: https://internal/patch.json\n  target:\n    kind: ConfigMap\n"},
+			remote: true,
+		},
+		{
+			name:   "remote generator file",
+			files:  map[string]string{"app/kustomization.yaml": "configMapGenerator:\n- name: cm\n  files:\n  - key=https://internal/secret\n"},
+			remote: true,
+		},
+		{
+			name:  "generator literal holding a URL",
+			files: map[string]string{"app/kustomization.yaml": "configMapGenerator:\n- name: cm\n  files:\n  - key=value.txt\n  literals:\n  - url=https://example.com\n"},
+		},
+		{
+			name:  "annotation holding a URL",
+			files: map[string]string{"app/kustomization.yaml": "commonAnnotations:\n  docs: https://example.com\n"},
+		},
+		{
+			name:   "remote openapi schema",
+			files:  map[string]string{"app/kustomization.yaml": "openapi:\n  path: https://internal/schema.json\n"},
+			remote: true,
+		},
+		{
+			name:   "flow-style inline transformer",
+			files:  map[string]string{"app/kustomization.yaml": "transformers:\n- '{apiVersion: builtin, kind: PatchTransformer, metadata: {name: p}, path: \"https://internal\"}'\n"},
+			remote: true,
+		},
+		{
+			name: "transformer file",
+			files: map[string]string{
+				"app/kustomization.yaml": "transformers:\n- patch.yaml\n",
+				"app/patch.yaml":         "apiVersion: builtin\nkind: PatchJson6902Transformer\nmetadata:\n  name: p\npath: http://10.0.0.1/\n",
+			},
+			remote: true,
+		},
+		{
+			name:   "helm chart generator",
+			files:  map[string]string{"app/kustomization.yaml": "generators:\n- |\n  apiVersion: builtin\n  kind: HelmChartInflationGenerator\n  metadata:\n    name: chart\n"},
+			remote: true,
+		},
+		{
+			name: "unused kustomization",
+			files: map[string]string{
+				"app/kustomization.yaml":   "resources:\n- cm.yaml\n",
+				"other/kustomization.yaml": "resources:\n- https://internal/cm.yaml\n",
+			},
+			remote: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fSys := filesys.MakeFsInMemory()
+			for name, content := range tt.files {
+				if err := fSys.WriteFile(kustomizeRepoRoot+"/"+name, []byte(content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := rejectRemoteReferences(fSys, kustomizeRepoRoot)
+			if tt.remote && err == nil {
+				t.Error("remote reference not rejected")
+			}
+			if !tt.remote && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCopyToFs(t *testing.T) {
+	src, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	files := map[string]int{
+		"app/kustomization.yaml": 100,
+		"app/large.bin":          maxKustomizeFileSize + 1,
+		"app/limit.yaml":         maxKustomizeFileSize,
+		".git/config":            100,
+	}
+	for name, size := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(src, "app", "passwd.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	fSys := filesys.MakeFsInMemory()
+	if err := copyToFs(src, kustomizeRepoRoot, fSys); err != nil {
+		t.Fatal(err)
+	}
+	for name, copied := range map[string]bool{
+		"app/kustomization.yaml": true,
+		"app/limit.yaml":         true,
+		"app/large.bin":          false,
+		"app/passwd.yaml":        false,
+		".git/config":            false,
+	} {
+		if exists := fSys.Exists(kustomizeRepoRoot + "/" + name); exists != copied {
+			t.Errorf("%s copied = %v, want %v", name, exists, copied)
+		}
+	}
+}
@@ -24,15 +24,16 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	kubeyaml "k8s.io/apimachinery/pkg/util/yaml"
 
 	//"k8s.io/client-go/pkg/apis/authorization"
@@ -40,13 +41,22 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	git "github.com/go-git/go-git/v5" // with go modules enabled (GO111MODULE=on or outside GOPATH)
+	git "github.com/go-git/go-git/v5"
 
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/sbose78/micro-application/api/v1alpha1"
 	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+	"helm.sh/helm/v3/pkg/chart"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	authorization "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 )
 
 // MicroApplicationReconciler reconciles a MicroApplication object
@@ -54,11 +64,65 @@ type MicroApplicationReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// DefaultSyncInterval is how often applications without
+	// spec.syncPolicy.interval are synced.
+	DefaultSyncInterval time.Duration
+
+	// PushEvents, when set, carries the MicroApplications to sync right away
+	// because their source was pushed to, see GitWebhookReceiver.
+	PushEvents <-chan event.GenericEvent
+
+	// ApplyMode selects between SubjectAccessReviews and impersonation of
+	// the creator.
+	ApplyMode ApplyMode
+
+	// PermissionCacheTTL is how long permission decisions are cached for, 0
+	// only shares them within a sync.
+	PermissionCacheTTL time.Duration
+	// LocalRBAC grants permissions from the RBAC rules in the informer cache
+	// before falling back to SubjectAccessReviews.
+	LocalRBAC bool
+
+	// RequireCreator refuses to sync applications without a recorded
+	// creator, instead of syncing them with the privileges of the controller.
+	RequireCreator bool
+	// WebhooksDisabled tells that applications aren't admitted through the
+	// mutating webhook, so that the creator they record isn't trusted.
+	WebhooksDisabled bool
+
+	// AllowCrossNamespace lets namespaced resources target another namespace
+	// than the destination namespace of their application, unless their
+	// project says otherwise.
+	AllowCrossNamespace bool
+
+	// Workspace is the directory repositories are cloned to, it is created
+	// readable by the controller only.
+	Workspace string
+
+	// Privileged are the creators trusted to sync anything without
+	// permission checks, nil trusts nobody.
+	Privileged *PrivilegedIdentities
+	// Recorder records an audit event whenever a privileged creator skips
+	// the permission checks.
+	Recorder record.EventRecorder
+
+	config *rest.Config
+	mapper meta.RESTMapper
+	// apiReader reads straight from the API server, for the objects the
+	// controller has no reason to keep an informer around for.
+	apiReader   client.Reader
+	drift       *driftWatcher
+	permissions *permissionEvaluator
 }
 
 //+kubebuilder:rbac:groups=argoproj.io,resources=microapplications,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=argoproj.io,resources=microapplications/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=argoproj.io,resources=microapplications/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=configmaps;secrets,verbs=get
+//+kubebuilder:rbac:groups="",resources=users;groups,verbs=impersonate
+//+kubebuilder:rbac:groups=authentication.k8s.io,resources=userextras/*,verbs=impersonate
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -70,7 +134,8 @@ type MicroApplicationReconciler struct {
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.7.2/pkg/reconcile
 func (r *MicroApplicationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = r.Log.WithValues("microapplication", req.NamespacedName)
+	log := r.Log.WithValues("microapplication", req.NamespacedName)
+	ctx = withSyncDecisions(ctx)
 
 	// Controller
 	// your logic here
@@ -82,103 +147,403 @@ func (r *MicroApplicationReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{}, nil
 	}
 
+	if !microApplication.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, log, microApplication)
+	}
+	if err := r.ensureFinalizer(ctx, microApplication); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// Ensure latest revision is checkedout
-	namespacePath := fmt.Sprintf("/tmp/%s", microApplication.Namespace)
-	os.Mkdir(namespacePath, 0755)
+	namespacedResourcePath := r.workspacePath(microApplication)
+	os.MkdirAll(namespacedResourcePath, 0700)
+
+	creator := r.creatorOf(microApplication)
+	if r.creatorMissing(creator) {
+		log.Info("refusing to sync an application without a creator")
+		microApplication.Status.Allowed = false
+		microApplication.Status.LastSync = time.Now().String()
+		setResources(microApplication, nil)
+		setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionFalse, reasonPermissionDenied, creatorMissingMessage)
+		setNotSynced(microApplication, reasonPermissionDenied, creatorMissingMessage)
+		recordSync(microApplication, "", argoprojiov1alpha1.SyncPermissionDenied, "", creatorMissingMessage)
+		r.updateStatus(ctx, log, microApplication)
+		// The creator can't be recorded after the fact, there is no point in
+		// trying again.
+		return ctrl.Result{}, nil
+	}
+	r.auditPrivileged(microApplication, creator, "Syncing")
 
-	namespacedResourcePath := fmt.Sprintf("/tmp/%s/%s", microApplication.Namespace, microApplication.Name)
-	os.Mkdir(namespacedResourcePath, 0755)
+	// The project restricts even privileged creators, and is checked before
+	// anything is fetched from the repository.
+	project, err := r.projectFor(ctx, microApplication)
+	if err != nil {
+		log.Error(err, "unable to get project")
+		setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionUnknown, reasonProjectUnavailable, err.Error())
+		setNotSynced(microApplication, reasonProjectUnavailable, "Project could not be read")
+		r.updateStatus(ctx, log, microApplication)
+		return ctrl.Result{}, err
+	}
+	if violation := checkProjectSource(project, microApplication.Spec.RepoURL); violation != "" {
+		return r.denySync(ctx, log, microApplication, "", reasonProjectViolation, violation)
+	}
 
-	// Update code from Git, ignore everything on the way ;)
-	cloneRepository(microApplication.Spec.RepoURL, namespacedResourcePath)
+	c, err := r.clientFor(creator)
+	if err != nil {
+		log.Error(err, "unable to impersonate creator", "creator", creator.Username)
+		return ctrl.Result{}, err
+	}
 
-	resources, _, err := parseManifests(namespacedResourcePath, []string{microApplication.Spec.Path})
+	auth, err := r.sourceAuth(ctx, c, microApplication, creator)
 	if err != nil {
-		println(err)
+		log.Error(err, "unable to get source credentials")
+		setCondition(microApplication, argoprojiov1alpha1.ConditionSourceReady, metav1.ConditionFalse, reasonCredentialsUnavailable, err.Error())
+		setNotSynced(microApplication, reasonCredentialsUnavailable, "Source credentials are unavailable")
+		r.updateStatus(ctx, log, microApplication)
+		return ctrl.Result{}, err
 	}
 
-	creator := microApplication.Annotations["generated-creator"]
-	isAllowed := true
+	var release *helmRelease
+	if microApplication.Spec.Helm != nil {
+		release, err = r.helmRelease(ctx, c, microApplication, creator)
+		if err != nil {
+			log.Error(err, "unable to get Helm values")
+			setCondition(microApplication, argoprojiov1alpha1.ConditionSourceReady, metav1.ConditionFalse, reasonValuesUnavailable, err.Error())
+			setNotSynced(microApplication, reasonValuesUnavailable, "Helm values are unavailable")
+			r.updateStatus(ctx, log, microApplication)
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Check out the target revision, re-resolving branches on every sync, or
+	// download the chart version it resolves to.
+	var ch *chart.Chart
+	if isChartRepository(microApplication) {
+		ch, err = fetchChart(ctx, microApplication.Spec.RepoURL, microApplication.Spec.Helm.Chart, microApplication.Spec.TargetRevision, auth)
+	} else {
+		_, err = cloneRepository(microApplication.Spec.RepoURL, namespacedResourcePath, microApplication.Spec.TargetRevision, auth)
+	}
+	if err != nil {
+		log.Error(err, "unable to fetch source", "repoURL", microApplication.Spec.RepoURL, "targetRevision", microApplication.Spec.TargetRevision)
+		setCondition(microApplication, argoprojiov1alpha1.ConditionSourceReady, metav1.ConditionFalse, reasonFetchFailed, err.Error())
+		setNotSynced(microApplication, reasonFetchFailed, "Source could not be fetched")
+		r.updateStatus(ctx, log, microApplication)
+		return ctrl.Result{}, err
+	}
+
+	var resources []*unstructured.Unstructured
+	var revision string
+	if ch != nil {
+		revision = ch.Metadata.Version
+		resources, err = renderChart(ch, release, nil)
+	} else {
+		resources, revision, err = renderManifests(log, namespacedResourcePath, microApplication.Spec, release)
+	}
+	if err != nil {
+		log.Error(err, "unable to parse manifests", "path", microApplication.Spec.Path)
+		setCondition(microApplication, argoprojiov1alpha1.ConditionSourceReady, metav1.ConditionFalse, reasonInvalidManifests, err.Error())
+		setNotSynced(microApplication, reasonInvalidManifests, "Manifests could not be parsed")
+		r.updateStatus(ctx, log, microApplication)
+		return ctrl.Result{}, err
+	}
+	setCondition(microApplication, argoprojiov1alpha1.ConditionSourceReady, metav1.ConditionTrue, reasonFetched, fmt.Sprintf("Checked out %s", revision))
+
+	// Namespaced resources without an explicit namespace go to the
+	// destination namespace and cluster-scoped ones lose theirs, for the
+	// permission checks, the apply and the inventory alike.
+	kinds := r.newKindResolver(resources)
+	violation, err := r.placeResources(kinds, project, microApplication, resources)
+	if err != nil {
+		log.Error(err, "unable to place resources in their namespace")
+		setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionUnknown, reasonPermissionCheckFailed, err.Error())
+		setNotSynced(microApplication, reasonPermissionCheckFailed, "Resources could not be placed in their namespace")
+		r.updateStatus(ctx, log, microApplication)
+		return ctrl.Result{}, err
+	}
+	if violation != "" {
+		return r.denySync(ctx, log, microApplication, revision, reasonCrossNamespace, violation)
+	}
+
+	violation, err = r.checkProjectResources(kinds, project, microApplication, resources)
+	if err != nil {
+		log.Error(err, "unable to check resources against project")
+		setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionUnknown, reasonPermissionCheckFailed, err.Error())
+		setNotSynced(microApplication, reasonPermissionCheckFailed, "Resources could not be checked against the project")
+		r.updateStatus(ctx, log, microApplication)
+		return ctrl.Result{}, err
+	}
+	if violation != "" {
+		return r.denySync(ctx, log, microApplication, revision, reasonProjectViolation, violation)
+	}
 
 	for _, resource := range resources {
+		setTrackingMetadata(resource, microApplication)
+	}
+	// Resources are compared with their live state once, for the permission
+	// checks as well as the preview or the apply.
+	diffs, diffErrs := diffResources(ctx, c, resources)
 
-		// skip validation if the annotation isn't set.
-		// this would happen if the admission controller wasn't installed.
-		// Definitely not recommended but I wouldn't inconevnience you ;)
-		if creator == "" {
-			break
-		}
-		if creator == "kube:admin" {
+	isAllowed := true
 
-			// kube:admin isn't a real user on the cluster
-			// Given that it's a well-known user, we'll skip the SubjectAccessReview
-			// check.
-			isAllowed = true
+	for i, resource := range resources {
+		if !r.checksPermissions(creator) {
 			break
 		}
 
-		targetNs := resource.GetNamespace()
-		if targetNs == "" {
-			targetNs = microApplication.Namespace
+		denied, err := r.checkPermissions(ctx, creator, kinds, resource, diffs[i])
+		if err != nil {
+			log.Error(err, "unable to check permissions", "creator", creator.Username)
+			setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionUnknown, reasonPermissionCheckFailed, err.Error())
+			setNotSynced(microApplication, reasonPermissionCheckFailed, "Permissions could not be checked")
+			r.updateStatus(ctx, log, microApplication)
+			return ctrl.Result{}, err
 		}
+		if denied != nil {
+			isAllowed = false
+			message := fmt.Sprintf("%s is not allowed to %s", creator.Username, denied)
+			microApplication.Status.Allowed = isAllowed
+			microApplication.Status.LastSync = time.Now().String()
+			setResources(microApplication, nil)
+			setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionFalse, reasonPermissionDenied, message)
+			setNotSynced(microApplication, reasonPermissionDenied, message)
+			recordSync(microApplication, revision, argoprojiov1alpha1.SyncPermissionDenied, creator.Username, message)
 
-		plural, _ := meta.UnsafeGuessKindToResource(resource.GroupVersionKind())
-		sar := authorization.SubjectAccessReview{
-			Spec: authorization.SubjectAccessReviewSpec{
-				User: creator,
-
-				ResourceAttributes: &authorization.ResourceAttributes{
-					Group:     resource.GroupVersionKind().Group,
-					Version:   resource.GroupVersionKind().Version,
-					Resource:  plural.Resource, // singular.Resource,
-					Namespace: targetNs,
-					Name:      resource.GetName(),
-					Verb:      "create",
-				},
-			},
+			r.updateStatus(ctx, log, microApplication)
+			return r.requeue(microApplication), nil
 		}
-		fmt.Println("Checking permissions for ", sar.Spec)
+	}
+	switch {
+	case r.impersonates(creator):
+		setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionTrue, reasonImpersonated, fmt.Sprintf("Resources are applied as %s", creator.Username))
+	case r.checksPermissions(creator):
+		setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionTrue, reasonPermissionsGranted, fmt.Sprintf("%s is allowed to apply every resource", creator.Username))
+	default:
+		setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionTrue, reasonPermissionsSkipped, fmt.Sprintf("Permission checks are skipped for creator %q", creator.Username))
+	}
 
-		err = r.Create(ctx, &sar, &client.CreateOptions{})
-		if err != nil {
-			return ctrl.Result{}, nil
+	// In preview mode nothing is applied nor pruned, the outcome of a sync is
+	// only described in the status.
+	if isPreview(microApplication) {
+		preview, previewErr := r.previewSync(log, microApplication, revision, resources, diffs, diffErrs)
+		microApplication.Status.Allowed = isAllowed
+		microApplication.Status.Preview = preview
+		setDrifted(microApplication, previewDrift(preview))
+		switch {
+		case previewErr != nil:
+			microApplication.Status.SyncStatus = argoprojiov1alpha1.ComparisonUnknown
+		case len(preview.Changes) > 0:
+			microApplication.Status.SyncStatus = argoprojiov1alpha1.ComparisonOutOfSync
+		default:
+			microApplication.Status.SyncStatus = argoprojiov1alpha1.ComparisonSynced
 		}
-		fmt.Println("sar.Status.Allowed", sar.Status.Allowed)
-		isAllowed = sar.Status.Allowed
-		if !isAllowed {
-			microApplication.Status.Allowed = isAllowed
-			microApplication.Status.LastSync = time.Now().String()
+		if previewErr != nil {
+			setCondition(microApplication, argoprojiov1alpha1.ConditionSynced, metav1.ConditionFalse, reasonPreviewFailed, previewErr.Error())
+		} else {
+			setCondition(microApplication, argoprojiov1alpha1.ConditionSynced, metav1.ConditionUnknown, reasonPreview,
+				fmt.Sprintf("Preview of %s: %d to create, %d to update, %d to delete", revision, preview.Create, preview.Update, preview.Delete))
+		}
+		r.updateStatus(ctx, log, microApplication)
+		if previewErr != nil {
+			return ctrl.Result{}, previewErr
+		}
+		return r.requeue(microApplication), nil
+	}
+	microApplication.Status.Preview = nil
 
-			err = r.Status().Update(ctx, microApplication, &client.UpdateOptions{})
-			if err != nil {
-				fmt.Println(err)
+	statuses, drifted, applyErr := r.applyResources(ctx, log, c, resources, diffs, diffErrs)
+	if selfHeals(microApplication) {
+		for _, resource := range resources {
+			if err := r.drift.watch(resource.GroupVersionKind()); err != nil {
+				log.Error(err, "unable to watch resources for self-heal", "gvk", resource.GroupVersionKind())
 			}
-			return ctrl.Result{}, nil
 		}
 	}
 
-	// kinda print, can be done better
-	k := fmt.Sprintf("kubectl apply -n %s -f %s/%s ", microApplication.Namespace, namespacedResourcePath, microApplication.Spec.Path)
-	fmt.Println(k)
+	// Only prune once everything rendered from the source made it to the
+	// cluster, a half-applied sync shouldn't take anything away.
+	orphans := orphanedResources(microApplication.Status.Inventory, resources)
+	var pruneErr error
+	if applyErr == nil && microApplication.Spec.SyncPolicy != nil && microApplication.Spec.SyncPolicy.Prune {
+		var pruned []argoprojiov1alpha1.ResourceStatus
+		pruned, orphans, pruneErr = r.pruneResources(ctx, log, c, microApplication, creator, orphans)
+		statuses = append(statuses, pruned...)
+	}
 
-	// actual command
-	cmd := exec.Command("kubectl", "apply", "-n", microApplication.Namespace, "-f", fmt.Sprintf("%s/%s", namespacedResourcePath, microApplication.Spec.Path))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	now := metav1.Now()
+	microApplication.Status.Allowed = isAllowed
+	microApplication.Status.LastSync = now.String()
+	microApplication.Status.LastSyncTime = &now
+	setResources(microApplication, statuses)
+	microApplication.Status.Inventory = nextInventory(microApplication.Status.Inventory, statuses, orphans)
+	setDrifted(microApplication, drifted)
+	// Resources which failed to apply and orphans left in the cluster keep the
+	// application out of sync.
+	if applyErr != nil || len(orphans) > 0 {
+		microApplication.Status.SyncStatus = argoprojiov1alpha1.ComparisonOutOfSync
+	} else {
+		microApplication.Status.SyncStatus = argoprojiov1alpha1.ComparisonSynced
+	}
 
-	err = cmd.Run()
-	if err != nil {
-		fmt.Println("Error while executing command", err)
+	// When impersonating, permissions are only known once the API server
+	// has rejected a resource.
+	if denied := permissionDenied(statuses); len(denied) > 0 {
+		message := fmt.Sprintf("%s is not allowed to apply %v", creator.Username, denied)
+		setCondition(microApplication, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionFalse, reasonPermissionDenied, message)
 	}
 
-	microApplication.Status.Allowed = isAllowed
-	microApplication.Status.LastSync = time.Now().String()
+	switch {
+	case applyErr != nil:
+		setCondition(microApplication, argoprojiov1alpha1.ConditionSynced, metav1.ConditionFalse, reasonSyncFailed, applyErr.Error())
+		recordSync(microApplication, revision, argoprojiov1alpha1.SyncFailed, creator.Username, applyErr.Error())
+	case pruneErr != nil:
+		setCondition(microApplication, argoprojiov1alpha1.ConditionSynced, metav1.ConditionFalse, reasonPruneFailed, pruneErr.Error())
+		recordSync(microApplication, revision, argoprojiov1alpha1.SyncFailed, creator.Username, pruneErr.Error())
+	default:
+		setCondition(microApplication, argoprojiov1alpha1.ConditionSynced, metav1.ConditionTrue, reasonSynced, fmt.Sprintf("Synced %d resources at %s", len(resources), revision))
+		recordSync(microApplication, revision, argoprojiov1alpha1.SyncSucceeded, creator.Username, "")
+	}
+	setHealthCondition(microApplication, statuses)
 
-	err = r.Status().Update(ctx, microApplication, &client.UpdateOptions{})
+	r.updateStatus(ctx, log, microApplication)
+	if applyErr != nil {
+		return ctrl.Result{}, applyErr
+	}
+	if pruneErr != nil {
+		return ctrl.Result{}, pruneErr
+	}
+	return r.requeue(microApplication), nil
+}
+
+// syncJitter spreads the syncs of applications sharing an interval, so that
+// they don't all hit the Git hosts and the API server at once.
+const syncJitter = 0.1
+
+// requeue schedules the next sync of app after its interval, plus up to 10%
+// of jitter. Failed syncs are retried with the controller's backoff instead.
+func (r *MicroApplicationReconciler) requeue(app *argoprojiov1alpha1.MicroApplication) ctrl.Result {
+	interval := r.DefaultSyncInterval
+	if app.Spec.SyncPolicy != nil && app.Spec.SyncPolicy.Interval != nil && app.Spec.SyncPolicy.Interval.Duration > 0 {
+		interval = app.Spec.SyncPolicy.Interval.Duration
+	}
+	if interval <= 0 {
+		return ctrl.Result{}
+	}
+	return ctrl.Result{RequeueAfter: wait.Jitter(interval, syncJitter)}
+}
+
+// sourceAuth returns the credentials for the repository of app, read from the
+// Secret in spec.source.secretRef on behalf of creator. It returns nil when no
+// Secret is referenced.
+func (r *MicroApplicationReconciler) sourceAuth(ctx context.Context, c client.Client, app *argoprojiov1alpha1.MicroApplication, creator authenticationv1.UserInfo) (transport.AuthMethod, error) {
+	if app.Spec.Source == nil || app.Spec.Source.SecretRef == nil {
+		return nil, nil
+	}
+	ref := argoprojiov1alpha1.ResourceRef{Version: "v1", Kind: "Secret", Namespace: app.Namespace, Name: app.Spec.Source.SecretRef.Name}
+	secret := &corev1.Secret{}
+	if err := r.getAsCreator(ctx, c, creator, ref, secret); err != nil {
+		return nil, err
+	}
+	return gitAuth(app.Spec.RepoURL, secret)
+}
+
+// getAsCreator reads obj, the core object ref points to, on behalf of creator,
+// with c when it impersonates creator.
+func (r *MicroApplicationReconciler) getAsCreator(ctx context.Context, c client.Client, creator authenticationv1.UserInfo, ref argoprojiov1alpha1.ResourceRef, obj client.Object) error {
+	// The controller can read any Secret, make sure it isn't used to hand
+	// out data the creator couldn't read on their own.
+	if r.checksPermissions(creator) {
+		p, err := newPermission(r.newKindResolver(nil), ref, "get", "")
+		if err != nil {
+			return err
+		}
+		allowed, err := r.isAllowed(ctx, creator, p)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("%s is not allowed to get %s %s/%s", creator.Username, ref.Kind, ref.Namespace, ref.Name)
+		}
+	}
+
+	// Secrets and ConfigMaps are read uncached, reading them through the
+	// manager's client would start an informer on every one in the cluster.
+	var reader client.Reader = c
+	if !r.impersonates(creator) {
+		reader = r.apiReader
+	}
+	return reader.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, obj)
+}
+
+// creatorMissingMessage explains why an application without a creator isn't
+// synced.
+const creatorMissingMessage = "No creator is recorded for this application, it has to be created through the mutating webhook"
+
+// creatorMissing tells whether creator is missing while the controller
+// requires one.
+func (r *MicroApplicationReconciler) creatorMissing(creator authenticationv1.UserInfo) bool {
+	return r.RequireCreator && creator.Username == ""
+}
+
+// requiresPermissionChecks tells whether resources synced on behalf of creator
+// have to go through a SubjectAccessReview first.
+func (r *MicroApplicationReconciler) requiresPermissionChecks(creator authenticationv1.UserInfo) bool {
+	// skip validation if the annotation isn't set.
+	// this would happen if the admission controller wasn't installed.
+	// Definitely not recommended but I wouldn't inconevnience you ;)
+	// --require-creator refuses to sync such applications altogether.
+	if creator.Username == "" {
+		return false
+	}
+
+	// Privileged identities, e.g. kube:admin on OpenShift, are trusted with
+	// anything.
+	return r.Privileged.match(creator) == ""
+}
+
+// isAllowed finds out whether user has permission p, through the permission
+// evaluator when there is one.
+func (r *MicroApplicationReconciler) isAllowed(ctx context.Context, user authenticationv1.UserInfo, p permission) (bool, error) {
+	if r.permissions == nil {
+		return r.subjectAccessReview(ctx, user, p)
+	}
+	return r.permissions.allowed(ctx, user, p)
+}
+
+// subjectAccessReview uses a SubjectAccessReview to find out whether user has
+// permission p.
+func (r *MicroApplicationReconciler) subjectAccessReview(ctx context.Context, user authenticationv1.UserInfo, p permission) (bool, error) {
+	ref := p.ref
+	sar := authorization.SubjectAccessReview{
+		Spec: authorization.SubjectAccessReviewSpec{
+			User:   user.Username,
+			Groups: user.Groups,
+			UID:    user.UID,
+
+			ResourceAttributes: &authorization.ResourceAttributes{
+				Group:       ref.Group,
+				Version:     ref.Version,
+				Resource:    p.resource,
+				Namespace:   ref.Namespace,
+				Name:        ref.Name,
+				Verb:        p.verb,
+				Subresource: p.subresource,
+			},
+		},
+	}
+	if len(user.Extra) > 0 {
+		sar.Spec.Extra = map[string]authorization.ExtraValue{}
+		for key, values := range user.Extra {
+			sar.Spec.Extra[key] = authorization.ExtraValue(values)
+		}
+	}
+	r.Log.V(1).Info("checking permission", "user", user.Username, "permission", p.String())
+
+	err := r.Create(ctx, &sar, &client.CreateOptions{})
 	if err != nil {
-		fmt.Println(err)
+		return false, err
 	}
-	return ctrl.Result{}, nil
+	r.Log.V(1).Info("checked permission", "user", user.Username, "permission", p.String(), "allowed", sar.Status.Allowed)
+	return sar.Status.Allowed, nil
 }
 
 // Copied from https://github.com/argoproj/gitops-engine/
@@ -214,29 +579,81 @@ func SplitYAML(yamlData []byte) ([]*unstructured.Unstructured, error) {
 	return objs, nil
 }
 
+// renderManifests renders the manifests at spec.Path in the clone at repoPath,
+// along with the revision they were rendered from. The path is rendered as a
+// Helm chart for release when spec.Helm is set, and built with kustomize when
+// it holds a kustomization or when spec.Kustomize is set.
+func renderManifests(log logr.Logger, repoPath string, spec argoprojiov1alpha1.MicroApplicationSpec, release *helmRelease) ([]*unstructured.Unstructured, string, error) {
+	if spec.Helm == nil && spec.Kustomize == nil && !isKustomization(filepath.Join(repoPath, spec.Path)) {
+		return parseManifests(log, repoPath, []string{spec.Path})
+	}
+
+	revision, err := headRevision(repoPath)
+	if err != nil {
+		return nil, "", err
+	}
+	var res []*unstructured.Unstructured
+	if spec.Helm != nil {
+		res, err = renderGitChart(repoPath, spec.Path, spec.Helm.ValueFiles, release)
+	} else {
+		res, err = renderKustomization(repoPath, spec.Path, spec.Kustomize)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return res, revision, nil
+}
+
+// headRevision returns the commit checked out in the clone at repoPath.
+func headRevision(repoPath string) (string, error) {
+	repo, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
 // copied from https://github.com/argoproj/gitops-engine/
-func parseManifests(repoPath string, paths []string) ([]*unstructured.Unstructured, string, error) {
+//
+// Only regular files are read: symbolic links, which are checked out as such,
+// could otherwise point to files outside of the repository.
+func parseManifests(log logr.Logger, repoPath string, paths []string) ([]*unstructured.Unstructured, string, error) {
 
-	cmd := exec.Command("git", "rev-parse", "HEAD")
-	cmd.Dir = repoPath
-	revision, err := cmd.CombinedOutput()
+	revision, err := headRevision(repoPath)
+	if err != nil {
+		return nil, "", err
+	}
+	root, err := filepath.EvalSymlinks(repoPath)
 	if err != nil {
 		return nil, "", err
 	}
 	var res []*unstructured.Unstructured
 	for i := range paths {
-		if err := filepath.Walk(filepath.Join(repoPath, paths[i]), func(path string, info os.FileInfo, err error) error {
+		// filepath.Walk doesn't follow symbolic links below the path, but
+		// does follow those leading to it.
+		dir, err := filepath.EvalSymlinks(filepath.Join(repoPath, paths[i]))
+		if err != nil {
+			return nil, "", err
+		}
+		if dir != root && !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return nil, "", fmt.Errorf("path %q is outside of the repository", paths[i])
+		}
+		if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			if info.IsDir() {
+			if !info.Mode().IsRegular() {
 				return nil
 			}
 			if ext := strings.ToLower(filepath.Ext(info.Name())); ext != ".json" && ext != ".yml" && ext != ".yaml" {
 				return nil
 			}
 
-			fmt.Println(path)
+			log.V(1).Info("reading manifest", "path", path)
 			data, err := ioutil.ReadFile(path)
 			if err != nil {
 				return err
@@ -253,78 +670,52 @@ func parseManifests(repoPath string, paths []string) ([]*unstructured.Unstructur
 			return nil, "", err
 		}
 	}
-	return res, string(revision), nil
+	return res, revision, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *MicroApplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
-
-	// Not the ideal place, but this is where we can set things up
-	if os.Getenv("INSTALL_ADMISSION_CONTROLLER") == "true" {
-		installAdmissionController()
-	}
-
 	p := predicate.Funcs{
 		UpdateFunc: func(e event.UpdateEvent) bool {
 			oldObject := e.ObjectOld.(*v1alpha1.MicroApplication)
 			newObject := e.ObjectNew.(*v1alpha1.MicroApplication)
-			return oldObject.ResourceVersion == newObject.ResourceVersion
+			// Periodic resyncs, spec changes and deletions, but not status
+			// updates.
+			return oldObject.ResourceVersion == newObject.ResourceVersion ||
+				oldObject.Generation != newObject.Generation ||
+				!newObject.DeletionTimestamp.IsZero()
 		},
 	}
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&argoprojiov1alpha1.MicroApplication{}).
-		WithEventFilter(p).
-		Complete(r)
-}
-
-func installAdmissionController() error {
-	// TODO: Create a separate mount path.
-	clonePath := "/tmp/setup/install"
-	manifestPath := "manifests/openshift"
-
-	manifestPathEnvValue := os.Getenv("ADMISSION_CONTROLLER_REPO_PATH")
-	if manifestPathEnvValue != "" {
-		manifestPath = manifestPathEnvValue
+		WithEventFilter(p)
+	if r.PushEvents != nil {
+		b = b.Watches(&source.Channel{Source: r.PushEvents}, &handler.EnqueueRequestForObject{})
 	}
-
-	cloneURL := "https://github.com/sbose78/micro-application-admission"
-	cloneRepository(cloneURL, clonePath)
-
-	// print as an FYI, can be done better
-	k := fmt.Sprintf("kubectl apply -f %s", clonePath)
-	fmt.Println(k)
-
-	// actual command
-	cmd := exec.Command("kubectl", "apply", "-f", fmt.Sprintf("%s/%s", clonePath, manifestPath))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err := cmd.Run()
+	ctl, err := b.Build(r)
 	if err != nil {
-		fmt.Println("Error ", err)
+		return err
 	}
-	return err
-}
-
-func cloneRepository(cloneURL string, clonePath string) error {
-
-	git.PlainClone(clonePath, false, &git.CloneOptions{
-		URL:      cloneURL,
-		Progress: os.Stdout,
-	})
+	r.config = mgr.GetConfig()
+	r.mapper = mgr.GetRESTMapper()
+	r.apiReader = mgr.GetAPIReader()
 
-	rr, err := git.PlainOpen(clonePath)
-	if err != nil {
+	if err = prepareWorkspace(r.Workspace); err != nil {
 		return err
 	}
-	w, err := rr.Worktree()
-	if err != nil {
-		return err
+
+	var local *rbacAuthorizer
+	if r.LocalRBAC {
+		local = &rbacAuthorizer{client: mgr.GetClient()}
 	}
+	r.permissions = newPermissionEvaluator(r.subjectAccessReview, r.PermissionCacheTTL, local)
 
-	err = w.Pull(&git.PullOptions{RemoteName: "origin"})
+	// Managed resources are watched on demand, as applications enabling
+	// self-heal apply them.
+	dyn, err := dynamic.NewForConfig(mgr.GetConfig())
 	if err != nil {
 		return err
 	}
-	return err
+	r.drift = newDriftWatcher(mgr.GetClient(), r.Log.WithName("selfheal"), ctl, dyn, mgr.GetRESTMapper())
+	return mgr.Add(r.drift)
 }
@@ -0,0 +1,135 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// permission is an action on a resource the creator of a MicroApplication has
+// to be allowed to perform for the controller to perform it on their behalf.
+type permission struct {
+	ref argoprojiov1alpha1.ResourceRef
+	// resource is the plural resource name of the kind of ref.
+	resource    string
+	verb        string
+	subresource string
+}
+
+// newPermission returns the permission to perform verb on subresource of ref,
+// resolving its resource name and scope with kinds. Cluster-scoped resources
+// are authorized without a namespace, whatever ref says.
+func newPermission(kinds *kindResolver, ref argoprojiov1alpha1.ResourceRef, verb, subresource string) (permission, error) {
+	info, err := kinds.resolve(schema.GroupVersionKind{Group: ref.Group, Version: ref.Version, Kind: ref.Kind})
+	if err != nil {
+		return permission{}, err
+	}
+	if info.clusterScoped {
+		ref.Namespace = ""
+	}
+	return permission{ref: ref, resource: info.resource, verb: verb, subresource: subresource}, nil
+}
+
+func (p permission) String() string {
+	resource := p.ref.Kind
+	if p.subresource != "" {
+		resource += "/" + p.subresource
+	}
+	if p.ref.Namespace == "" {
+		return fmt.Sprintf("%s %s %s", p.verb, resource, p.ref.Name)
+	}
+	return fmt.Sprintf("%s %s %s/%s", p.verb, resource, p.ref.Namespace, p.ref.Name)
+}
+
+// requiredPermissions returns what the creator has to be allowed to do for
+// resource to be applied: create it when it doesn't exist yet, patch it
+// otherwise, since server-side apply is a patch. A manifest setting a status
+// also requires patching the status subresource, so that it can't be used to
+// forge the status of a resource. The scale subresource is never checked:
+// replicas set by a manifest are applied with a patch of the resource itself,
+// not through the scale subresource.
+//
+// Whether the resource exists is taken from diff, and only looked up when it
+// couldn't be diffed. Looking it up ahead of the check means a creator who may
+// only create resources can't overwrite someone else's.
+func (r *MicroApplicationReconciler) requiredPermissions(ctx context.Context, kinds *kindResolver, resource *unstructured.Unstructured, diff *resourceDiff) ([]permission, error) {
+	ref := resourceRef(resource)
+
+	verb := "patch"
+	if diff != nil {
+		if !diff.exists {
+			verb = "create"
+		}
+	} else {
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(resource.GroupVersionKind())
+		err := r.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, live)
+		switch {
+		case apierrors.IsNotFound(err), meta.IsNoMatchError(err):
+			// The kind itself may not be served until a
+			// CustomResourceDefinition rendered along with resource is
+			// applied.
+			verb = "create"
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	p, err := newPermission(kinds, ref, verb, "")
+	if err != nil {
+		return nil, err
+	}
+	permissions := []permission{p}
+
+	if status, found, _ := unstructured.NestedMap(resource.Object, "status"); found && len(status) > 0 {
+		p, err := newPermission(kinds, ref, "patch", "status")
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, nil
+}
+
+// checkPermissions checks every permission creator needs for resource, whose
+// diff may be nil, to be applied, and returns the first one they lack, if any.
+func (r *MicroApplicationReconciler) checkPermissions(ctx context.Context, creator authenticationv1.UserInfo, kinds *kindResolver, resource *unstructured.Unstructured, diff *resourceDiff) (*permission, error) {
+	permissions, err := r.requiredPermissions(ctx, kinds, resource, diff)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range permissions {
+		allowed, err := r.isAllowed(ctx, creator, p)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRequiredPermissions(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	live := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "live"}}
+	r := &MicroApplicationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithRuntimeObjects(live).Build(),
+		mapper: mapper,
+	}
+
+	withStatus := newTestResource("v1", "ConfigMap", "team-a", "missing")
+	withStatus.Object["status"] = map[string]interface{}{"phase": "Ready"}
+	tests := []struct {
+		name     string
+		resource *unstructured.Unstructured
+		// diff is nil when the resource couldn't be diffed, leaving
+		// requiredPermissions to look it up.
+		diff *resourceDiff
+		want []string
+	}{
+		{
+			name:     "diffed existing",
+			resource: newTestResource("v1", "ConfigMap", "team-a", "missing"),
+			diff:     &resourceDiff{exists: true},
+			want:     []string{"patch ConfigMap team-a/missing"},
+		},
+		{
+			name:     "diffed missing",
+			resource: newTestResource("v1", "ConfigMap", "team-a", "live"),
+			diff:     &resourceDiff{exists: false},
+			want:     []string{"create ConfigMap team-a/live"},
+		},
+		{
+			name:     "looked up existing",
+			resource: newTestResource("v1", "ConfigMap", "team-a", "live"),
+			want:     []string{"patch ConfigMap team-a/live"},
+		},
+		{
+			name:     "looked up missing",
+			resource: newTestResource("v1", "ConfigMap", "team-a", "missing"),
+			want:     []string{"create ConfigMap team-a/missing"},
+		},
+		{
+			name:     "status",
+			resource: withStatus,
+			diff:     &resourceDiff{exists: false},
+			want:     []string{"create ConfigMap team-a/missing", "patch ConfigMap/status team-a/missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			permissions, err := r.requiredPermissions(context.Background(), r.newKindResolver(nil), tt.resource, tt.diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range permissions {
+				got = append(got, p.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPermission(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	r := &MicroApplicationReconciler{mapper: mapper}
+
+	// Kinds defined by CustomResourceDefinitions of the same sync aren't
+	// served yet, their scope comes from the definition.
+	newCRD := func(kind, plural, scope string) *unstructured.Unstructured {
+		crd := newTestResource("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", plural+".example.com")
+		crd.Object["spec"] = map[string]interface{}{
+			"group": "example.com",
+			"names": map[string]interface{}{"kind": kind, "plural": plural},
+			"scope": scope,
+		}
+		return crd
+	}
+	kinds := r.newKindResolver([]*unstructured.Unstructured{
+		newCRD("Widget", "widgets", "Cluster"),
+		newCRD("Gadget", "gadgets", "Namespaced"),
+	})
+
+	tests := []struct {
+		name     string
+		resource *unstructured.Unstructured
+		want     permission
+		wantErr  bool
+	}{
+		{
+			name:     "namespaced",
+			resource: newTestResource("v1", "ConfigMap", "team-a", "config"),
+			want:     permission{ref: resourceRef(newTestResource("v1", "ConfigMap", "team-a", "config")), resource: "configmaps", verb: "create"},
+		},
+		{
+			// A namespace in the manifest of a cluster-scoped resource
+			// would have the permission checked in the wrong scope.
+			name:     "cluster-scoped with a namespace",
+			resource: newTestResource("v1", "Namespace", "team-a", "team-b"),
+			want:     permission{ref: resourceRef(newTestResource("v1", "Namespace", "", "team-b")), resource: "namespaces", verb: "create"},
+		},
+		{
+			name:     "pending cluster-scoped",
+			resource: newTestResource("example.com/v1", "Widget", "team-a", "widget"),
+			want:     permission{ref: resourceRef(newTestResource("example.com/v1", "Widget", "", "widget")), resource: "widgets", verb: "create"},
+		},
+		{
+			name:     "pending namespaced",
+			resource: newTestResource("example.com/v1", "Gadget", "team-a", "gadget"),
+			want:     permission{ref: resourceRef(newTestResource("example.com/v1", "Gadget", "team-a", "gadget")), resource: "gadgets", verb: "create"},
+		},
+		{
+			name:     "unknown kind",
+			resource: newTestResource("example.com/v1", "Gizmo", "team-a", "gizmo"),
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newPermission(kinds, resourceRef(tt.resource), "create", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newPermission() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(p, tt.want) {
+				t.Errorf("newPermission() = %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
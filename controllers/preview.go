@@ -0,0 +1,85 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// isPreview tells whether app is only to be previewed, not applied.
+func isPreview(app *argoprojiov1alpha1.MicroApplication) bool {
+	return app.Spec.SyncPolicy != nil && app.Spec.SyncPolicy.Mode == argoprojiov1alpha1.SyncModePreview
+}
+
+// previewSync describes what syncing resources, rendered from revision, would
+// change, as told by diffs and diffErrs, see diffResources. Resources the
+// dry-run rejects are reported as failed and their errors are aggregated.
+func (r *MicroApplicationReconciler) previewSync(log logr.Logger, app *argoprojiov1alpha1.MicroApplication, revision string, resources []*unstructured.Unstructured, diffs []*resourceDiff, diffErrs []error) (*argoprojiov1alpha1.Preview, error) {
+	preview := &argoprojiov1alpha1.Preview{Revision: revision, Time: metav1.Now()}
+	var errs []error
+
+	for i, resource := range resources {
+		ref := resourceRef(resource)
+		diff, err := diffs[i], diffErrs[i]
+		if err != nil {
+			log.Error(err, "unable to preview resource", "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name)
+			preview.Changes = append(preview.Changes, argoprojiov1alpha1.ResourceChange{ResourceRef: ref, Action: argoprojiov1alpha1.ChangeFailed, Message: err.Error()})
+			preview.Failed++
+			errs = append(errs, fmt.Errorf("%s %s/%s: %v", ref.Kind, ref.Namespace, ref.Name, err))
+			continue
+		}
+
+		change := diff.change(ref)
+		if change == nil {
+			preview.Unchanged++
+			continue
+		}
+		if change.Action == argoprojiov1alpha1.ChangeCreate {
+			preview.Create++
+		} else {
+			preview.Update++
+		}
+		preview.Changes = append(preview.Changes, *change)
+	}
+
+	if app.Spec.SyncPolicy != nil && app.Spec.SyncPolicy.Prune {
+		for _, orphan := range orphanedResources(app.Status.Inventory, resources) {
+			preview.Changes = append(preview.Changes, argoprojiov1alpha1.ResourceChange{ResourceRef: orphan, Action: argoprojiov1alpha1.ChangeDelete})
+			preview.Delete++
+		}
+	}
+	return preview, utilerrors.NewAggregate(errs)
+}
+
+// previewDrift returns the resources of preview which exist in the source but
+// are missing from the cluster or differ from it.
+func previewDrift(preview *argoprojiov1alpha1.Preview) []argoprojiov1alpha1.ResourceChange {
+	var drifted []argoprojiov1alpha1.ResourceChange
+	for _, change := range preview.Changes {
+		if change.Action == argoprojiov1alpha1.ChangeCreate || change.Action == argoprojiov1alpha1.ChangeUpdate {
+			drifted = append(drifted, change)
+		}
+	}
+	return drifted
+}
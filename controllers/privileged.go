@@ -0,0 +1,90 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// PrivilegedIdentities are the creators whose applications are synced
+// without any permission checks, as the controller.
+type PrivilegedIdentities struct {
+	// Users are matched by exact name.
+	Users []string `json:"users,omitempty"`
+	// Groups match every creator who is a member of one of them.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// DefaultPrivilegedIdentities are used when no privileged identities are
+// configured. kube:admin is the OpenShift bootstrap user, which isn't a real
+// user SubjectAccessReviews could be made for.
+var DefaultPrivilegedIdentities = &PrivilegedIdentities{Users: []string{"kube:admin"}}
+
+// LoadPrivilegedIdentities reads privileged identities from the YAML or JSON
+// file at path, e.g. a mounted ConfigMap:
+//
+//	users:
+//	- kube:admin
+//	groups:
+//	- system:cluster-admins
+func LoadPrivilegedIdentities(path string) (*PrivilegedIdentities, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	identities := &PrivilegedIdentities{}
+	if err := yaml.UnmarshalStrict(data, identities); err != nil {
+		return nil, fmt.Errorf("unable to parse privileged identities in %s: %v", path, err)
+	}
+	return identities, nil
+}
+
+// match returns why user is privileged, or an empty string if they aren't.
+func (p *PrivilegedIdentities) match(user authenticationv1.UserInfo) string {
+	if p == nil || user.Username == "" {
+		return ""
+	}
+	if contains(p.Users, user.Username) {
+		return fmt.Sprintf("user %s is privileged", user.Username)
+	}
+	for _, group := range user.Groups {
+		if contains(p.Groups, group) {
+			return fmt.Sprintf("group %s is privileged", group)
+		}
+	}
+	return ""
+}
+
+// auditPrivileged records an event on app when its creator is privileged, so
+// that every sync or deletion skipping the permission checks leaves a trace.
+func (r *MicroApplicationReconciler) auditPrivileged(app *argoprojiov1alpha1.MicroApplication, creator authenticationv1.UserInfo, action string) {
+	reason := r.Privileged.match(creator)
+	if reason == "" || r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(app, corev1.EventTypeWarning, "PermissionChecksBypassed",
+		"%s on behalf of %s without permission checks: %s", action, creator.Username, reason)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+func TestPrivilegedIdentitiesMatch(t *testing.T) {
+	privileged := &PrivilegedIdentities{Users: []string{"kube:admin"}, Groups: []string{"system:cluster-admins"}}
+	tests := []struct {
+		name       string
+		identities *PrivilegedIdentities
+		user       authenticationv1.UserInfo
+		privileged bool
+	}{
+		{name: "user", identities: privileged, user: authenticationv1.UserInfo{Username: "kube:admin"}, privileged: true},
+		{name: "group", identities: privileged, user: authenticationv1.UserInfo{Username: "alice", Groups: []string{"team-a", "system:cluster-admins"}}, privileged: true},
+		{name: "other user", identities: privileged, user: authenticationv1.UserInfo{Username: "alice", Groups: []string{"team-a"}}},
+		{name: "user named after a group", identities: privileged, user: authenticationv1.UserInfo{Username: "system:cluster-admins"}},
+		{name: "group named after a user", identities: privileged, user: authenticationv1.UserInfo{Username: "alice", Groups: []string{"kube:admin"}}},
+		{name: "case", identities: privileged, user: authenticationv1.UserInfo{Username: "Kube:Admin"}},
+		// Applications without a creator are never privileged, whatever
+		// their groups.
+		{name: "no creator", identities: &PrivilegedIdentities{Users: []string{""}}, user: authenticationv1.UserInfo{Groups: []string{"system:cluster-admins"}}},
+		{name: "nobody", user: authenticationv1.UserInfo{Username: "kube:admin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := tt.identities.match(tt.user)
+			if (reason != "") != tt.privileged {
+				t.Errorf("match(%+v) = %q, want privileged %v", tt.user, reason, tt.privileged)
+			}
+		})
+	}
+}
+
+func TestLoadPrivilegedIdentities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "privileged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    *PrivilegedIdentities
+		wantErr bool
+	}{
+		{
+			name:    "yaml",
+			content: "users:\n- kube:admin\ngroups:\n- system:cluster-admins\n",
+			want:    &PrivilegedIdentities{Users: []string{"kube:admin"}, Groups: []string{"system:cluster-admins"}},
+		},
+		{
+			name:    "json",
+			content: `{"groups": ["system:cluster-admins"]}`,
+			want:    &PrivilegedIdentities{Groups: []string{"system:cluster-admins"}},
+		},
+		{
+			name:    "empty",
+			content: "",
+			want:    &PrivilegedIdentities{},
+		},
+		{
+			// A typo mustn't go unnoticed.
+			name:    "unknown field",
+			content: "user:\n- kube:admin\n",
+			wantErr: true,
+		},
+		{
+			name:    "malformed",
+			content: "users: kube:admin\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadPrivilegedIdentities(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadPrivilegedIdentities() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadPrivilegedIdentities() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadPrivilegedIdentities(filepath.Join(dir, "missing")); err == nil {
+		t.Error("LoadPrivilegedIdentities() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+//+kubebuilder:rbac:groups=argoproj.io,resources=microprojects,verbs=get;list;watch
+
+// projectFor returns the project restricting app, or nil when its namespace
+// isn't bound to any. Namespaces are bound by the projects themselves, which
+// are cluster-scoped, so that namespace admins can't lift the restrictions.
+// A namespace bound to several projects is an error.
+func (r *MicroApplicationReconciler) projectFor(ctx context.Context, app *argoprojiov1alpha1.MicroApplication) (*argoprojiov1alpha1.MicroProject, error) {
+	projects := &argoprojiov1alpha1.MicroProjectList{}
+	if err := r.List(ctx, projects); err != nil {
+		return nil, err
+	}
+
+	var bound []*argoprojiov1alpha1.MicroProject
+	for i := range projects.Items {
+		if matchesPattern(projects.Items[i].Spec.Namespaces, app.Namespace) {
+			bound = append(bound, &projects.Items[i])
+		}
+	}
+	switch len(bound) {
+	case 0:
+		return nil, nil
+	case 1:
+		return bound[0], nil
+	}
+	return nil, fmt.Errorf("namespace %s is bound to projects %s and %s", app.Namespace, bound[0].Name, bound[1].Name)
+}
+
+// checkProjectSource tells why project doesn't allow syncing from repoURL, or
+// returns an empty string if it does.
+func checkProjectSource(project *argoprojiov1alpha1.MicroProject, repoURL string) string {
+	if project == nil || matchesPattern(project.Spec.SourceRepos, repoURL) {
+		return ""
+	}
+	return fmt.Sprintf("repository %s is not a source of project %s", repoURL, project.Name)
+}
+
+// checkProjectResources tells why project doesn't allow applying one of
+// resources, or returns an empty string if it allows every one of them.
+func (r *MicroApplicationReconciler) checkProjectResources(kinds *kindResolver, project *argoprojiov1alpha1.MicroProject, app *argoprojiov1alpha1.MicroApplication, resources []*unstructured.Unstructured) (string, error) {
+	if project == nil {
+		return "", nil
+	}
+	for _, resource := range resources {
+		info, err := kinds.resolve(resource.GroupVersionKind())
+		if err != nil {
+			return "", err
+		}
+		if violation := checkProjectResource(project, app, resource, info.clusterScoped); violation != "" {
+			return violation, nil
+		}
+	}
+	return "", nil
+}
+
+func checkProjectResource(project *argoprojiov1alpha1.MicroProject, app *argoprojiov1alpha1.MicroApplication, resource *unstructured.Unstructured, clusterScoped bool) string {
+	spec := &project.Spec
+	gk := resource.GroupVersionKind().GroupKind()
+	if clusterScoped {
+		name := fmt.Sprintf("%s %s", gk, resource.GetName())
+		switch {
+		case !matchesGroupKind(spec.ClusterResourceAllowList, gk):
+			return fmt.Sprintf("%s: cluster-scoped kind not allowed by project %s", name, project.Name)
+		case matchesGroupKind(spec.ClusterResourceDenyList, gk):
+			return fmt.Sprintf("%s: cluster-scoped kind denied by project %s", name, project.Name)
+		}
+		return ""
+	}
+
+	name := fmt.Sprintf("%s %s/%s", gk, resource.GetNamespace(), resource.GetName())
+	switch {
+	case len(spec.NamespaceResourceAllowList) > 0 && !matchesGroupKind(spec.NamespaceResourceAllowList, gk):
+		return fmt.Sprintf("%s: kind not allowed by project %s", name, project.Name)
+	case matchesGroupKind(spec.NamespaceResourceDenyList, gk):
+		return fmt.Sprintf("%s: kind denied by project %s", name, project.Name)
+	}
+
+	namespace := resource.GetNamespace()
+	if len(spec.DestinationNamespaces) == 0 {
+		if namespace != app.Namespace {
+			return fmt.Sprintf("%s: project %s only allows namespace %s", name, project.Name, app.Namespace)
+		}
+	} else if !matchesPattern(spec.DestinationNamespaces, namespace) {
+		return fmt.Sprintf("%s: namespace %s is not a destination of project %s", name, namespace, project.Name)
+	}
+	return ""
+}
+
+// matchesPattern tells whether value matches one of patterns. Malformed
+// patterns match nothing.
+func matchesPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesGroupKind(patterns []argoprojiov1alpha1.GroupKindPattern, gk schema.GroupKind) bool {
+	for _, pattern := range patterns {
+		groupOK, _ := path.Match(pattern.Group, gk.Group)
+		kindOK, _ := path.Match(pattern.Kind, gk.Kind)
+		if groupOK && kindOK {
+			return true
+		}
+	}
+	return false
+}
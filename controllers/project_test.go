@@ -0,0 +1,167 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+func TestMatchesPattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		value    string
+		match    bool
+	}{
+		{name: "no patterns", value: "team-a"},
+		{name: "exact", patterns: []string{"team-a"}, value: "team-a", match: true},
+		{name: "other", patterns: []string{"team-a"}, value: "team-b"},
+		{name: "glob", patterns: []string{"team-*"}, value: "team-a", match: true},
+		{name: "any pattern", patterns: []string{"other", "team-?"}, value: "team-a", match: true},
+		{name: "repository", patterns: []string{"https://github.com/org/*"}, value: "https://github.com/org/repo", match: true},
+		{name: "other organization", patterns: []string{"https://github.com/org/*"}, value: "https://github.com/other/repo"},
+		// Stars don't cross slashes, a pattern can't reach below its level.
+		{name: "nested repository", patterns: []string{"https://github.com/org/*"}, value: "https://github.com/org/group/repo"},
+		{name: "star and slashes", patterns: []string{"*"}, value: "https://github.com/org/repo"},
+		{name: "malformed", patterns: []string{"team-["}, value: "team-["},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if match := matchesPattern(tt.patterns, tt.value); match != tt.match {
+				t.Errorf("matchesPattern(%q, %q) = %v, want %v", tt.patterns, tt.value, match, tt.match)
+			}
+		})
+	}
+}
+
+func TestCheckProjectSource(t *testing.T) {
+	project := &argoprojiov1alpha1.MicroProject{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+	project.Spec.SourceRepos = []string{"https://github.com/org/*", "git@github.com:org/*"}
+	empty := &argoprojiov1alpha1.MicroProject{ObjectMeta: metav1.ObjectMeta{Name: "empty"}}
+
+	tests := []struct {
+		name    string
+		project *argoprojiov1alpha1.MicroProject
+		repoURL string
+		allowed bool
+	}{
+		{name: "no project", repoURL: "https://example.com/repo", allowed: true},
+		{name: "https", project: project, repoURL: "https://github.com/org/repo", allowed: true},
+		{name: "scp-like", project: project, repoURL: "git@github.com:org/repo.git", allowed: true},
+		{name: "other organization", project: project, repoURL: "https://github.com/other/repo"},
+		{name: "other host", project: project, repoURL: "https://gitlab.com/org/repo"},
+		{name: "no sources", project: empty, repoURL: "https://github.com/org/repo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violation := checkProjectSource(tt.project, tt.repoURL)
+			if (violation == "") != tt.allowed {
+				t.Errorf("checkProjectSource(%q) = %q, want allowed %v", tt.repoURL, violation, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckProjectResource(t *testing.T) {
+	app := &argoprojiov1alpha1.MicroApplication{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"}}
+	restricted := &argoprojiov1alpha1.MicroProject{ObjectMeta: metav1.ObjectMeta{Name: "restricted"}}
+	open := &argoprojiov1alpha1.MicroProject{ObjectMeta: metav1.ObjectMeta{Name: "open"}}
+	open.Spec.DestinationNamespaces = []string{"team-*"}
+	open.Spec.ClusterResourceAllowList = []argoprojiov1alpha1.GroupKindPattern{{Group: "*", Kind: "*"}}
+	open.Spec.ClusterResourceDenyList = []argoprojiov1alpha1.GroupKindPattern{{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole*"}}
+	open.Spec.NamespaceResourceAllowList = []argoprojiov1alpha1.GroupKindPattern{{Group: "", Kind: "*"}, {Group: "apps", Kind: "Deployment"}}
+	open.Spec.NamespaceResourceDenyList = []argoprojiov1alpha1.GroupKindPattern{{Group: "", Kind: "Secret"}}
+
+	tests := []struct {
+		name          string
+		project       *argoprojiov1alpha1.MicroProject
+		resource      *unstructured.Unstructured
+		clusterScoped bool
+		allowed       bool
+	}{
+		{
+			name:     "own namespace",
+			project:  restricted,
+			resource: newTestResource("v1", "ConfigMap", "team-a", "config"),
+			allowed:  true,
+		},
+		{
+			name:     "other namespace",
+			project:  restricted,
+			resource: newTestResource("v1", "ConfigMap", "team-b", "config"),
+		},
+		{
+			name:          "cluster-scoped without allow list",
+			project:       restricted,
+			resource:      newTestResource("v1", "Namespace", "", "team-b"),
+			clusterScoped: true,
+		},
+		{
+			name:     "destination namespace",
+			project:  open,
+			resource: newTestResource("v1", "ConfigMap", "team-b", "config"),
+			allowed:  true,
+		},
+		{
+			name:     "not a destination namespace",
+			project:  open,
+			resource: newTestResource("v1", "ConfigMap", "kube-system", "config"),
+		},
+		{
+			name:     "allowed kind",
+			project:  open,
+			resource: newTestResource("apps/v1", "Deployment", "team-a", "web"),
+			allowed:  true,
+		},
+		{
+			name:     "kind not allowed",
+			project:  open,
+			resource: newTestResource("apps/v1", "StatefulSet", "team-a", "db"),
+		},
+		{
+			name:     "denied kind",
+			project:  open,
+			resource: newTestResource("v1", "Secret", "team-a", "credentials"),
+		},
+		{
+			name:          "allowed cluster-scoped kind",
+			project:       open,
+			resource:      newTestResource("v1", "Namespace", "", "team-b"),
+			clusterScoped: true,
+			allowed:       true,
+		},
+		{
+			name:          "denied cluster-scoped kind",
+			project:       open,
+			resource:      newTestResource("rbac.authorization.k8s.io/v1", "ClusterRoleBinding", "", "admins"),
+			clusterScoped: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violation := checkProjectResource(tt.project, app, tt.resource, tt.clusterScoped)
+			if (violation == "") != tt.allowed {
+				t.Errorf("checkProjectResource() = %q, want allowed %v", violation, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+const (
+	// trackingLabel is set on every resource applied by the controller.
+	trackingLabel = "microapplications.argoproj.io/managed"
+	// trackingAnnotation records the <namespace>/<name> of the
+	// MicroApplication a resource was applied by.
+	trackingAnnotation = "microapplications.argoproj.io/tracking-id"
+)
+
+// trackingID identifies app in the tracking annotation of the resources it
+// applies.
+func trackingID(app *argoprojiov1alpha1.MicroApplication) string {
+	return fmt.Sprintf("%s/%s", app.Namespace, app.Name)
+}
+
+// setTrackingMetadata marks resource as managed by app.
+func setTrackingMetadata(resource *unstructured.Unstructured, app *argoprojiov1alpha1.MicroApplication) {
+	labels := resource.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[trackingLabel] = "true"
+	resource.SetLabels(labels)
+
+	annotations := resource.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[trackingAnnotation] = trackingID(app)
+	resource.SetAnnotations(annotations)
+}
+
+// inventoryKey identifies a resource regardless of the API version it was
+// rendered with.
+func inventoryKey(ref argoprojiov1alpha1.ResourceRef) argoprojiov1alpha1.ResourceRef {
+	ref.Version = ""
+	return ref
+}
+
+// orphanedResources returns the resources of inventory which are no longer
+// rendered from the source.
+func orphanedResources(inventory []argoprojiov1alpha1.ResourceRef, rendered []*unstructured.Unstructured) []argoprojiov1alpha1.ResourceRef {
+	current := map[argoprojiov1alpha1.ResourceRef]bool{}
+	for _, resource := range rendered {
+		current[inventoryKey(resourceRef(resource))] = true
+	}
+
+	var orphans []argoprojiov1alpha1.ResourceRef
+	for _, ref := range inventory {
+		if !current[inventoryKey(ref)] {
+			orphans = append(orphans, ref)
+		}
+	}
+	return orphans
+}
+
+// nextInventory computes the inventory after a sync: every resource applied
+// successfully, every resource which failed to apply but was already known
+// from a previous sync, and every orphan which is still in the cluster.
+func nextInventory(previous []argoprojiov1alpha1.ResourceRef, statuses []argoprojiov1alpha1.ResourceStatus, orphans []argoprojiov1alpha1.ResourceRef) []argoprojiov1alpha1.ResourceRef {
+	known := map[argoprojiov1alpha1.ResourceRef]bool{}
+	for _, ref := range previous {
+		known[inventoryKey(ref)] = true
+	}
+
+	var inventory []argoprojiov1alpha1.ResourceRef
+	for _, status := range statuses {
+		switch status.Status {
+		case argoprojiov1alpha1.ResourceSynced:
+			inventory = append(inventory, status.ResourceRef)
+		case argoprojiov1alpha1.ResourceSyncFailed, argoprojiov1alpha1.ResourcePermissionDenied:
+			if known[inventoryKey(status.ResourceRef)] {
+				inventory = append(inventory, status.ResourceRef)
+			}
+		}
+	}
+	return append(inventory, orphans...)
+}
+
+// pruneResources deletes orphans from the cluster with c, on behalf of
+// creator. It returns the outcome for each orphan and the orphans which are
+// still in the cluster and have to stay in the inventory.
+//
+// Resources which no longer carry the tracking annotation of app were taken
+// over by someone else and are dropped from the inventory without deleting
+// them.
+func (r *MicroApplicationReconciler) pruneResources(ctx context.Context, log logr.Logger, c client.Client, app *argoprojiov1alpha1.MicroApplication, creator authenticationv1.UserInfo, orphans []argoprojiov1alpha1.ResourceRef) ([]argoprojiov1alpha1.ResourceStatus, []argoprojiov1alpha1.ResourceRef, error) {
+	var statuses []argoprojiov1alpha1.ResourceStatus
+	var remaining []argoprojiov1alpha1.ResourceRef
+	var errs []error
+
+	for _, ref := range orphans {
+		status := argoprojiov1alpha1.ResourceStatus{ResourceRef: ref}
+
+		err := r.pruneResource(ctx, c, app, creator, ref)
+		switch {
+		case err == errNotTracked:
+			log.Info("not pruning resource managed by someone else", "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name)
+			continue
+		case err != nil:
+			log.Error(err, "unable to prune resource", "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name)
+			status.Status = argoprojiov1alpha1.ResourcePruneFailed
+			status.Message = err.Error()
+			errs = append(errs, fmt.Errorf("%s %s/%s: %v", ref.Kind, ref.Namespace, ref.Name, err))
+			remaining = append(remaining, ref)
+		default:
+			log.Info("pruned resource", "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name)
+			status.Status = argoprojiov1alpha1.ResourcePruned
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, remaining, utilerrors.NewAggregate(errs)
+}
+
+// errNotTracked is returned by pruneResource when the live resource isn't
+// tracked by the MicroApplication being synced.
+var errNotTracked = fmt.Errorf("resource is not tracked by this MicroApplication")
+
+// isGone tells whether err means a resource no longer exists: either the
+// resource itself or its kind, e.g. when the CustomResourceDefinition of a
+// custom resource was deleted first.
+func isGone(err error) bool {
+	return apierrors.IsNotFound(err) || meta.IsNoMatchError(err)
+}
+
+// pruneResource deletes a single resource after checking that creator may
+// delete it. A resource which is already gone isn't an error.
+func (r *MicroApplicationReconciler) pruneResource(ctx context.Context, c client.Client, app *argoprojiov1alpha1.MicroApplication, creator authenticationv1.UserInfo, ref argoprojiov1alpha1.ResourceRef) error {
+	if r.checksPermissions(creator) {
+		p, err := newPermission(r.newKindResolver(nil), ref, "delete", "")
+		if isGone(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		allowed, err := r.isAllowed(ctx, creator, p)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("%s is not allowed to delete this resource", creator.Username)
+		}
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(schema.GroupVersionKind{Group: ref.Group, Version: ref.Version, Kind: ref.Kind})
+	err := c.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, obj)
+	if isGone(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if obj.GetAnnotations()[trackingAnnotation] != trackingID(app) {
+		return errNotTracked
+	}
+
+	err = c.Delete(ctx, obj, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if isGone(err) {
+		return nil
+	}
+	return err
+}
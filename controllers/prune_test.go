@@ -0,0 +1,174 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+var (
+	configMapA = argoprojiov1alpha1.ResourceRef{Version: "v1", Kind: "ConfigMap", Namespace: "team-a", Name: "a"}
+	configMapB = argoprojiov1alpha1.ResourceRef{Version: "v1", Kind: "ConfigMap", Namespace: "team-a", Name: "b"}
+	widget     = argoprojiov1alpha1.ResourceRef{Group: "example.com", Version: "v1", Kind: "Widget", Name: "w"}
+)
+
+func TestOrphanedResources(t *testing.T) {
+	tests := []struct {
+		name      string
+		inventory []argoprojiov1alpha1.ResourceRef
+		rendered  []*unstructured.Unstructured
+		want      []argoprojiov1alpha1.ResourceRef
+	}{
+		{name: "empty inventory", rendered: []*unstructured.Unstructured{newTestResource("v1", "ConfigMap", "team-a", "a")}},
+		{
+			name:      "still rendered",
+			inventory: []argoprojiov1alpha1.ResourceRef{configMapA},
+			rendered:  []*unstructured.Unstructured{newTestResource("v1", "ConfigMap", "team-a", "a")},
+		},
+		{
+			name:      "removed from the source",
+			inventory: []argoprojiov1alpha1.ResourceRef{configMapA, configMapB},
+			rendered:  []*unstructured.Unstructured{newTestResource("v1", "ConfigMap", "team-a", "a")},
+			want:      []argoprojiov1alpha1.ResourceRef{configMapB},
+		},
+		{
+			name:      "rendered with another API version",
+			inventory: []argoprojiov1alpha1.ResourceRef{widget},
+			rendered:  []*unstructured.Unstructured{newTestResource("example.com/v2", "Widget", "", "w")},
+		},
+		{
+			name:      "moved to another namespace",
+			inventory: []argoprojiov1alpha1.ResourceRef{configMapA},
+			rendered:  []*unstructured.Unstructured{newTestResource("v1", "ConfigMap", "team-b", "a")},
+			want:      []argoprojiov1alpha1.ResourceRef{configMapA},
+		},
+		{
+			name:      "everything removed",
+			inventory: []argoprojiov1alpha1.ResourceRef{configMapA, widget},
+			want:      []argoprojiov1alpha1.ResourceRef{configMapA, widget},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orphanedResources(tt.inventory, tt.rendered); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orphanedResources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextInventory(t *testing.T) {
+	status := func(ref argoprojiov1alpha1.ResourceRef, s argoprojiov1alpha1.ResourceSyncStatus) argoprojiov1alpha1.ResourceStatus {
+		return argoprojiov1alpha1.ResourceStatus{ResourceRef: ref, Status: s}
+	}
+	tests := []struct {
+		name     string
+		previous []argoprojiov1alpha1.ResourceRef
+		statuses []argoprojiov1alpha1.ResourceStatus
+		orphans  []argoprojiov1alpha1.ResourceRef
+		want     []argoprojiov1alpha1.ResourceRef
+	}{
+		{
+			name:     "applied",
+			statuses: []argoprojiov1alpha1.ResourceStatus{status(configMapA, argoprojiov1alpha1.ResourceSynced)},
+			want:     []argoprojiov1alpha1.ResourceRef{configMapA},
+		},
+		{
+			name:     "new resource failing to apply",
+			statuses: []argoprojiov1alpha1.ResourceStatus{status(configMapA, argoprojiov1alpha1.ResourceSyncFailed)},
+		},
+		{
+			name:     "known resource failing to apply",
+			previous: []argoprojiov1alpha1.ResourceRef{configMapA},
+			statuses: []argoprojiov1alpha1.ResourceStatus{status(configMapA, argoprojiov1alpha1.ResourceSyncFailed)},
+			want:     []argoprojiov1alpha1.ResourceRef{configMapA},
+		},
+		{
+			name:     "known resource denied",
+			previous: []argoprojiov1alpha1.ResourceRef{configMapA},
+			statuses: []argoprojiov1alpha1.ResourceStatus{status(configMapA, argoprojiov1alpha1.ResourcePermissionDenied)},
+			want:     []argoprojiov1alpha1.ResourceRef{configMapA},
+		},
+		{
+			name:     "known resource under another API version",
+			previous: []argoprojiov1alpha1.ResourceRef{widget},
+			statuses: []argoprojiov1alpha1.ResourceStatus{status(argoprojiov1alpha1.ResourceRef{Group: "example.com", Version: "v2", Kind: "Widget", Name: "w"}, argoprojiov1alpha1.ResourceSyncFailed)},
+			want:     []argoprojiov1alpha1.ResourceRef{{Group: "example.com", Version: "v2", Kind: "Widget", Name: "w"}},
+		},
+		{
+			name:     "orphans left in the cluster",
+			previous: []argoprojiov1alpha1.ResourceRef{configMapA, configMapB},
+			statuses: []argoprojiov1alpha1.ResourceStatus{status(configMapA, argoprojiov1alpha1.ResourceSynced)},
+			orphans:  []argoprojiov1alpha1.ResourceRef{configMapB},
+			want:     []argoprojiov1alpha1.ResourceRef{configMapA, configMapB},
+		},
+		{
+			name:     "orphans pruned",
+			previous: []argoprojiov1alpha1.ResourceRef{configMapA, configMapB},
+			statuses: []argoprojiov1alpha1.ResourceStatus{status(configMapA, argoprojiov1alpha1.ResourceSynced)},
+			want:     []argoprojiov1alpha1.ResourceRef{configMapA},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextInventory(tt.previous, tt.statuses, tt.orphans); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nextInventory() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// noMatchClient fails to read any resource as if its kind wasn't served.
+type noMatchClient struct {
+	client.Client
+}
+
+func (noMatchClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	return &meta.NoKindMatchError{GroupKind: gvk.GroupKind(), SearchedVersions: []string{gvk.Version}}
+}
+
+func TestPruneResourcesOfRemovedKind(t *testing.T) {
+	r := &MicroApplicationReconciler{mapper: meta.NewDefaultRESTMapper([]schema.GroupVersion{{Group: "example.com", Version: "v1"}})}
+	app := &argoprojiov1alpha1.MicroApplication{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"}}
+	inventory := []argoprojiov1alpha1.ResourceRef{widget}
+
+	for _, creator := range []authenticationv1.UserInfo{{}, {Username: "alice"}} {
+		statuses, remaining, err := r.pruneResources(context.Background(), ctrl.Log, noMatchClient{}, app, creator, inventory)
+		if err != nil {
+			t.Fatalf("creator %q: %v", creator.Username, err)
+		}
+		if len(remaining) > 0 {
+			t.Errorf("creator %q: %v remain in the inventory", creator.Username, remaining)
+		}
+		if len(statuses) != 1 || statuses[0].Status != argoprojiov1alpha1.ResourcePruned {
+			t.Errorf("creator %q: statuses = %+v, want the Widget pruned", creator.Username, statuses)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// kindInfo is what authorizing a kind of resource takes.
+type kindInfo struct {
+	// resource is the plural resource name of the kind.
+	resource      string
+	clusterScoped bool
+}
+
+// kindResolver resolves the resource names and scopes of kinds with the
+// RESTMapper. Kinds it doesn't know yet are resolved from the
+// CustomResourceDefinitions rendered along with them, so that an application
+// can ship a CustomResourceDefinition and its custom resources together.
+type kindResolver struct {
+	mapper  meta.RESTMapper
+	pending map[schema.GroupKind]kindInfo
+}
+
+// newKindResolver returns a resolver for kinds known to the API server or
+// defined by one of resources.
+func (r *MicroApplicationReconciler) newKindResolver(resources []*unstructured.Unstructured) *kindResolver {
+	k := &kindResolver{mapper: r.mapper, pending: map[schema.GroupKind]kindInfo{}}
+	for _, resource := range resources {
+		if resource.GroupVersionKind().GroupKind() != (schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}) {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(resource.Object, "spec", "group")
+		kind, _, _ := unstructured.NestedString(resource.Object, "spec", "names", "kind")
+		plural, _, _ := unstructured.NestedString(resource.Object, "spec", "names", "plural")
+		scope, _, _ := unstructured.NestedString(resource.Object, "spec", "scope")
+		if kind == "" || plural == "" {
+			continue
+		}
+		k.pending[schema.GroupKind{Group: group, Kind: kind}] = kindInfo{resource: plural, clusterScoped: scope == "Cluster"}
+	}
+	return k
+}
+
+// resolve returns the resource name and scope of gvk.
+func (k *kindResolver) resolve(gvk schema.GroupVersionKind) (kindInfo, error) {
+	mapping, err := k.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		if info, ok := k.pending[gvk.GroupKind()]; ok && meta.IsNoMatchError(err) {
+			return info, nil
+		}
+		return kindInfo{}, err
+	}
+	return kindInfo{
+		resource:      mapping.Resource.Resource,
+		clusterScoped: mapping.Scope.Name() == meta.RESTScopeNameRoot,
+	}, nil
+}
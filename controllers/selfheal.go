@@ -0,0 +1,239 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// The managed resources are read and watched with the identity of the
+// controller, whatever their kind.
+//+kubebuilder:rbac:groups=*,resources=*,verbs=get;list;watch
+
+const (
+	// selfHealBaseDelay and selfHealMaxDelay bound the exponential backoff
+	// between two self-heals of an application, so that the controller doesn't
+	// fight another controller changing the same fields.
+	selfHealBaseDelay = time.Second
+	selfHealMaxDelay  = 5 * time.Minute
+	// selfHealQuietPeriod resets the backoff of an application which didn't
+	// need healing for that long.
+	selfHealQuietPeriod = 5 * time.Minute
+)
+
+// driftWatcher watches the kinds of resources applied on behalf of
+// applications with spec.syncPolicy.selfHeal, and triggers a sync of the
+// owning application when one of its resources is changed or deleted.
+//
+// Only resources carrying the tracking label are watched. Kinds are watched
+// from the first time they are applied until the controller stops.
+type driftWatcher struct {
+	client     client.Client
+	log        logr.Logger
+	controller controller.Controller
+	dynamic    dynamic.Interface
+	mapper     meta.RESTMapper
+
+	mu sync.Mutex
+	// ctx is set once the watcher is started, kinds watched before that are
+	// started along with it.
+	ctx      context.Context
+	watched  map[schema.GroupVersionKind]bool
+	limiter  workqueue.RateLimiter
+	lastHeal map[types.NamespacedName]time.Time
+}
+
+func newDriftWatcher(c client.Client, log logr.Logger, ctrl controller.Controller, dyn dynamic.Interface, mapper meta.RESTMapper) *driftWatcher {
+	return &driftWatcher{
+		client:     c,
+		log:        log,
+		controller: ctrl,
+		dynamic:    dyn,
+		mapper:     mapper,
+		watched:    map[schema.GroupVersionKind]bool{},
+		limiter:    workqueue.NewItemExponentialFailureRateLimiter(selfHealBaseDelay, selfHealMaxDelay),
+		lastHeal:   map[types.NamespacedName]time.Time{},
+	}
+}
+
+// selfHeals tells whether app is to be synced as soon as its resources drift.
+func selfHeals(app *argoprojiov1alpha1.MicroApplication) bool {
+	return app.Spec.SyncPolicy != nil && app.Spec.SyncPolicy.SelfHeal && !isPreview(app)
+}
+
+// NeedLeaderElection makes sure only the replica running the controller
+// watches the managed resources.
+func (w *driftWatcher) NeedLeaderElection() bool {
+	return true
+}
+
+// Start starts the watches requested so far, and any further ones as they are
+// requested, until ctx is done.
+func (w *driftWatcher) Start(ctx context.Context) error {
+	w.mu.Lock()
+	w.ctx = ctx
+	for gvk := range w.watched {
+		if err := w.startWatch(gvk); err != nil {
+			w.log.Error(err, "unable to watch managed resources", "gvk", gvk)
+			delete(w.watched, gvk)
+		}
+	}
+	w.mu.Unlock()
+
+	<-ctx.Done()
+	return nil
+}
+
+// watch makes sure the managed resources of kind gvk are watched.
+func (w *driftWatcher) watch(gvk schema.GroupVersionKind) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.watched[gvk] {
+		return nil
+	}
+	if w.ctx != nil {
+		if err := w.startWatch(gvk); err != nil {
+			return err
+		}
+	}
+	w.watched[gvk] = true
+	return nil
+}
+
+// startWatch runs an informer for the managed resources of kind gvk, feeding
+// the controller. w.mu must be held.
+func (w *driftWatcher) startWatch(gvk schema.GroupVersionKind) error {
+	mapping, err := w.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+	informer := dynamicinformer.NewFilteredDynamicInformer(w.dynamic, mapping.Resource, metav1.NamespaceAll, 0, toolscache.Indexers{},
+		func(opts *metav1.ListOptions) {
+			opts.LabelSelector = trackingLabel + "=true"
+		}).Informer()
+	if err := w.controller.Watch(&source.Informer{Informer: informer}, w); err != nil {
+		return err
+	}
+	go informer.Run(w.ctx.Done())
+	w.log.Info("watching managed resources", "gvk", gvk)
+	return nil
+}
+
+// Create ignores the resources listed when an informer starts, and those
+// created by the controller itself.
+func (w *driftWatcher) Create(event.CreateEvent, workqueue.RateLimitingInterface) {}
+
+// Update triggers a self-heal when the spec or metadata of a resource changed,
+// unless the controller made the change itself.
+func (w *driftWatcher) Update(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+	if drifted(e.ObjectOld, e.ObjectNew) && !appliedByController(e.ObjectNew) {
+		w.enqueueOwner(e.ObjectNew, q)
+	}
+}
+
+// Delete triggers a self-heal, recreating the resource.
+func (w *driftWatcher) Delete(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	w.enqueueOwner(e.Object, q)
+}
+
+// Generic isn't used by informers.
+func (w *driftWatcher) Generic(event.GenericEvent, workqueue.RateLimitingInterface) {}
+
+// drifted tells whether an update could have made a resource drift from its
+// source. Updates of the status only don't change the generation of the
+// kinds which have one.
+func drifted(old, new client.Object) bool {
+	if new.GetGeneration() == 0 {
+		return true
+	}
+	return old.GetGeneration() != new.GetGeneration() ||
+		!reflect.DeepEqual(old.GetLabels(), new.GetLabels()) ||
+		!reflect.DeepEqual(old.GetAnnotations(), new.GetAnnotations())
+}
+
+// appliedByController tells whether the last change of obj was an apply of the
+// controller, according to its managed fields. Such changes are the outcome of
+// a sync rather than drift, and mustn't count towards the self-heal backoff.
+// Entries are only timestamped to the second, when another manager changed
+// obj within the same second the change is taken for drift.
+func appliedByController(obj client.Object) bool {
+	var last *metav1.Time
+	byController := false
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Time == nil {
+			continue
+		}
+		ours := entry.Manager == fieldManager && entry.Operation == metav1.ManagedFieldsOperationApply
+		switch {
+		case last == nil || last.Before(entry.Time):
+			last = entry.Time
+			byController = ours
+		case last.Equal(entry.Time):
+			byController = byController && ours
+		}
+	}
+	return byController
+}
+
+// enqueueOwner enqueues the application obj was applied by, if it self-heals,
+// after its self-heal backoff.
+func (w *driftWatcher) enqueueOwner(obj client.Object, q workqueue.RateLimitingInterface) {
+	parts := strings.SplitN(obj.GetAnnotations()[trackingAnnotation], "/", 2)
+	if len(parts) != 2 {
+		return
+	}
+	key := types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+
+	app := &argoprojiov1alpha1.MicroApplication{}
+	if err := w.client.Get(context.Background(), key, app); err != nil || !selfHeals(app) {
+		return
+	}
+
+	w.mu.Lock()
+	if last, ok := w.lastHeal[key]; ok && time.Since(last) > selfHealQuietPeriod {
+		w.limiter.Forget(key)
+	}
+	w.lastHeal[key] = time.Now()
+	delay := w.limiter.When(key)
+	w.mu.Unlock()
+
+	w.log.Info("resource changed, healing", "microapplication", key, "kind", obj.GetObjectKind().GroupVersionKind().Kind,
+		"namespace", obj.GetNamespace(), "name", obj.GetName(), "delay", delay)
+	q.AddAfter(reconcile.Request{NamespacedName: key}, delay)
+}
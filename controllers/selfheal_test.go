@@ -0,0 +1,74 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestAppliedByController(t *testing.T) {
+	earlier := metav1.NewTime(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC))
+	later := metav1.NewTime(earlier.Add(time.Minute))
+	apply := func(manager string, at metav1.Time) metav1.ManagedFieldsEntry {
+		return metav1.ManagedFieldsEntry{Manager: manager, Operation: metav1.ManagedFieldsOperationApply, Time: &at}
+	}
+	update := func(manager string, at metav1.Time) metav1.ManagedFieldsEntry {
+		return metav1.ManagedFieldsEntry{Manager: manager, Operation: metav1.ManagedFieldsOperationUpdate, Time: &at}
+	}
+	tests := []struct {
+		name    string
+		entries []metav1.ManagedFieldsEntry
+		want    bool
+	}{
+		{name: "no managed fields"},
+		{name: "applied by the controller", entries: []metav1.ManagedFieldsEntry{apply(fieldManager, later)}, want: true},
+		{
+			name:    "applied by the controller after an edit",
+			entries: []metav1.ManagedFieldsEntry{apply(fieldManager, later), update("kubectl-edit", earlier)},
+			want:    true,
+		},
+		{
+			name:    "edited after an apply of the controller",
+			entries: []metav1.ManagedFieldsEntry{apply(fieldManager, earlier), update("kubectl-edit", later)},
+		},
+		{
+			name:    "edited within the second of an apply of the controller",
+			entries: []metav1.ManagedFieldsEntry{apply(fieldManager, later), update("kubectl-edit", later)},
+		},
+		{
+			name:    "applied by another manager",
+			entries: []metav1.ManagedFieldsEntry{apply(fieldManager, earlier), apply("kubectl", later)},
+		},
+		{
+			name:    "updated under the name of the controller",
+			entries: []metav1.ManagedFieldsEntry{update(fieldManager, later)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &unstructured.Unstructured{}
+			obj.SetManagedFields(tt.entries)
+			if got := appliedByController(obj); got != tt.want {
+				t.Errorf("appliedByController() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+// Reasons used in the conditions of a MicroApplication.
+const (
+	reasonCredentialsUnavailable = "CredentialsUnavailable"
+	reasonValuesUnavailable      = "ValuesUnavailable"
+	reasonFetchFailed            = "FetchFailed"
+	reasonInvalidManifests       = "InvalidManifests"
+	reasonFetched                = "Fetched"
+	reasonPermissionCheckFailed  = "PermissionCheckFailed"
+	reasonPermissionDenied       = "PermissionDenied"
+	reasonProjectUnavailable     = "ProjectUnavailable"
+	reasonProjectViolation       = "ProjectViolation"
+	reasonCrossNamespace         = "CrossNamespace"
+	reasonPermissionsGranted     = "Granted"
+	reasonPermissionsSkipped     = "ChecksSkipped"
+	reasonImpersonated           = "Impersonated"
+	reasonSyncFailed             = "SyncFailed"
+	reasonPruneFailed            = "PruneFailed"
+	reasonSynced                 = "Synced"
+	reasonNotSynced              = "NotSynced"
+	reasonPreview                = "Preview"
+	reasonPreviewFailed          = "PreviewFailed"
+	reasonDeletionFailed         = "DeletionFailed"
+	reasonHealthy                = "Healthy"
+	reasonProgressing            = "Progressing"
+	reasonDegraded               = "Degraded"
+)
+
+// maxStatusResources is the number of resources listed in status.resources
+// and status.drifted, the others are only counted, so that large applications
+// don't push their status over the size limit of an object.
+const maxStatusResources = 100
+
+// setResources records statuses in app, those which failed first so that they
+// are the last ones to be left out.
+func setResources(app *argoprojiov1alpha1.MicroApplication, statuses []argoprojiov1alpha1.ResourceStatus) {
+	statuses = append([]argoprojiov1alpha1.ResourceStatus(nil), statuses...)
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return !succeeded(statuses[i]) && succeeded(statuses[j])
+	})
+	app.Status.ResourcesOmitted = 0
+	if len(statuses) > maxStatusResources {
+		app.Status.ResourcesOmitted = int32(len(statuses) - maxStatusResources)
+		statuses = statuses[:maxStatusResources]
+	}
+	app.Status.Resources = statuses
+}
+
+// succeeded tells whether the resource of status was applied or pruned.
+func succeeded(status argoprojiov1alpha1.ResourceStatus) bool {
+	return status.Status == argoprojiov1alpha1.ResourceSynced || status.Status == argoprojiov1alpha1.ResourcePruned
+}
+
+// setDrifted records the drifted resources in app.
+func setDrifted(app *argoprojiov1alpha1.MicroApplication, drifted []argoprojiov1alpha1.ResourceChange) {
+	app.Status.DriftedOmitted = 0
+	if len(drifted) > maxStatusResources {
+		app.Status.DriftedOmitted = int32(len(drifted) - maxStatusResources)
+		drifted = drifted[:maxStatusResources]
+	}
+	app.Status.Drifted = drifted
+}
+
+// setCondition sets a condition of app, for the generation currently being
+// reconciled.
+func setCondition(app *argoprojiov1alpha1.MicroApplication, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&app.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: app.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setNotSynced marks app as not synced because an earlier stage failed.
+func setNotSynced(app *argoprojiov1alpha1.MicroApplication, reason, message string) {
+	setCondition(app, argoprojiov1alpha1.ConditionSynced, metav1.ConditionFalse, reason, message)
+	setCondition(app, argoprojiov1alpha1.ConditionHealthy, metav1.ConditionUnknown, reasonNotSynced, "Resources were not synced")
+}
+
+// setHealthCondition aggregates the health of every applied resource into the
+// Healthy condition: degraded wins over progressing, which wins over healthy.
+func setHealthCondition(app *argoprojiov1alpha1.MicroApplication, statuses []argoprojiov1alpha1.ResourceStatus) {
+	var degraded, progressing []string
+	for _, s := range statuses {
+		name := fmt.Sprintf("%s %s/%s", s.Kind, s.Namespace, s.Name)
+		switch s.Health {
+		case argoprojiov1alpha1.ResourceDegraded:
+			degraded = append(degraded, name)
+		case argoprojiov1alpha1.ResourceProgressing:
+			progressing = append(progressing, name)
+		}
+	}
+
+	switch {
+	case len(degraded) > 0:
+		setCondition(app, argoprojiov1alpha1.ConditionHealthy, metav1.ConditionFalse, reasonDegraded, fmt.Sprintf("Degraded: %v", degraded))
+	case len(progressing) > 0:
+		setCondition(app, argoprojiov1alpha1.ConditionHealthy, metav1.ConditionFalse, reasonProgressing, fmt.Sprintf("Progressing: %v", progressing))
+	default:
+		setCondition(app, argoprojiov1alpha1.ConditionHealthy, metav1.ConditionTrue, reasonHealthy, "All resources are healthy")
+	}
+}
+
+// defaultRevisionHistoryLimit is the number of entries kept in status.history
+// when spec.revisionHistoryLimit isn't set.
+const defaultRevisionHistoryLimit = 10
+
+// recordSync records the revision which was synced on behalf of creator. A new
+// history entry is only added when the revision, the creator or the result
+// differ from the latest entry, so the history tells when each of them changed
+// rather than repeating every periodic sync.
+func recordSync(app *argoprojiov1alpha1.MicroApplication, revision string, result argoprojiov1alpha1.SyncResult, creator, message string) {
+	// Nothing is applied when permissions are denied, what's deployed is
+	// still whatever was synced before.
+	if result != argoprojiov1alpha1.SyncPermissionDenied {
+		app.Status.Sync = &argoprojiov1alpha1.SyncStatus{
+			Revision:       revision,
+			TargetRevision: app.Spec.TargetRevision,
+		}
+	}
+
+	history := app.Status.History
+	if n := len(history); n > 0 {
+		last := &history[n-1]
+		if last.Revision == revision && last.Creator == creator && last.Result == result {
+			last.Message = message
+			return
+		}
+	}
+	history = append(history, argoprojiov1alpha1.SyncHistory{
+		Revision: revision,
+		Time:     metav1.Now(),
+		Result:   result,
+		Creator:  creator,
+		Message:  message,
+	})
+
+	limit := defaultRevisionHistoryLimit
+	if app.Spec.RevisionHistoryLimit != nil {
+		limit = int(*app.Spec.RevisionHistoryLimit)
+	}
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	app.Status.History = history
+}
+
+// denySync marks app as denied by policy for reason: nothing is synced.
+func (r *MicroApplicationReconciler) denySync(ctx context.Context, log logr.Logger, app *argoprojiov1alpha1.MicroApplication, revision, reason, message string) (ctrl.Result, error) {
+	log.Info("sync denied", "reason", reason, "message", message)
+	app.Status.Allowed = false
+	app.Status.LastSync = time.Now().String()
+	setResources(app, nil)
+	setCondition(app, argoprojiov1alpha1.ConditionPermissionsGranted, metav1.ConditionFalse, reason, message)
+	setNotSynced(app, reason, message)
+	recordSync(app, revision, argoprojiov1alpha1.SyncPermissionDenied, r.creatorOf(app).Username, message)
+	r.updateStatus(ctx, log, app)
+	return r.requeue(app), nil
+}
+
+// updateStatus writes the status of app back to the API server.
+func (r *MicroApplicationReconciler) updateStatus(ctx context.Context, log logr.Logger, app *argoprojiov1alpha1.MicroApplication) {
+	app.Status.ObservedGeneration = app.Generation
+	err := r.Status().Update(ctx, app, &client.UpdateOptions{})
+	if err != nil {
+		log.Error(err, "unable to update status")
+	}
+}
+
+// permissionDenied lists the resources the API server refused to apply on
+// behalf of the creator.
+func permissionDenied(statuses []argoprojiov1alpha1.ResourceStatus) []string {
+	var denied []string
+	for _, s := range statuses {
+		if s.Status == argoprojiov1alpha1.ResourcePermissionDenied {
+			denied = append(denied, fmt.Sprintf("%s %s/%s", s.Kind, s.Namespace, s.Name))
+		}
+	}
+	return denied
+}
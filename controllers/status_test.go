@@ -0,0 +1,100 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	argoprojiov1alpha1 "github.com/sbose78/micro-application/api/v1alpha1"
+)
+
+func TestSetResources(t *testing.T) {
+	statuses := func(n int, status argoprojiov1alpha1.ResourceSyncStatus) []argoprojiov1alpha1.ResourceStatus {
+		var s []argoprojiov1alpha1.ResourceStatus
+		for i := 0; i < n; i++ {
+			ref := argoprojiov1alpha1.ResourceRef{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: fmt.Sprintf("%s-%d", status, i)}
+			s = append(s, argoprojiov1alpha1.ResourceStatus{ResourceRef: ref, Status: status})
+		}
+		return s
+	}
+
+	tests := []struct {
+		name        string
+		statuses    []argoprojiov1alpha1.ResourceStatus
+		wantLen     int
+		wantOmitted int32
+		wantFailed  int
+	}{
+		{name: "none"},
+		{
+			name:     "under the limit",
+			statuses: statuses(10, argoprojiov1alpha1.ResourceSynced),
+			wantLen:  10,
+		},
+		{
+			name:        "over the limit",
+			statuses:    statuses(maxStatusResources+5, argoprojiov1alpha1.ResourceSynced),
+			wantLen:     maxStatusResources,
+			wantOmitted: 5,
+		},
+		{
+			name:        "failures are kept",
+			statuses:    append(statuses(maxStatusResources, argoprojiov1alpha1.ResourceSynced), statuses(3, argoprojiov1alpha1.ResourceSyncFailed)...),
+			wantLen:     maxStatusResources,
+			wantOmitted: 3,
+			wantFailed:  3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &argoprojiov1alpha1.MicroApplication{}
+			app.Status.ResourcesOmitted = 42
+			setResources(app, tt.statuses)
+			if len(app.Status.Resources) != tt.wantLen || app.Status.ResourcesOmitted != tt.wantOmitted {
+				t.Fatalf("got %d resources, %d omitted, want %d, %d omitted", len(app.Status.Resources), app.Status.ResourcesOmitted, tt.wantLen, tt.wantOmitted)
+			}
+			failed := 0
+			for _, status := range app.Status.Resources {
+				if !succeeded(status) {
+					failed++
+				}
+			}
+			if failed != tt.wantFailed {
+				t.Errorf("got %d failed resources, want %d", failed, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestSetDrifted(t *testing.T) {
+	var drifted []argoprojiov1alpha1.ResourceChange
+	for i := 0; i < maxStatusResources+1; i++ {
+		ref := argoprojiov1alpha1.ResourceRef{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: fmt.Sprint(i)}
+		drifted = append(drifted, argoprojiov1alpha1.ResourceChange{ResourceRef: ref, Action: argoprojiov1alpha1.ChangeUpdate})
+	}
+
+	app := &argoprojiov1alpha1.MicroApplication{}
+	setDrifted(app, drifted)
+	if len(app.Status.Drifted) != maxStatusResources || app.Status.DriftedOmitted != 1 {
+		t.Fatalf("got %d drifted, %d omitted, want %d, 1 omitted", len(app.Status.Drifted), app.Status.DriftedOmitted, maxStatusResources)
+	}
+	setDrifted(app, drifted[:1])
+	if len(app.Status.Drifted) != 1 || app.Status.DriftedOmitted != 0 {
+		t.Errorf("got %d drifted, %d omitted, want 1, 0 omitted", len(app.Status.Drifted), app.Status.DriftedOmitted)
+	}
+}
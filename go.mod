@@ -3,12 +3,22 @@ module github.com/sbose78/micro-application
 go 1.15
 
 require (
+	github.com/Masterminds/semver/v3 v3.1.0
+	github.com/evanphx/json-patch v4.9.0+incompatible
 	github.com/go-git/go-git/v5 v5.3.0
 	github.com/go-logr/logr v0.3.0
 	github.com/onsi/ginkgo v1.14.1
 	github.com/onsi/gomega v1.10.2
-	k8s.io/api v0.19.2
-	k8s.io/apimachinery v0.19.2
-	k8s.io/client-go v0.19.2
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	helm.sh/helm/v3 v3.4.2
+	k8s.io/api v0.19.4
+	k8s.io/apimachinery v0.19.4
+	k8s.io/client-go v0.19.4
 	sigs.k8s.io/controller-runtime v0.7.2
+	sigs.k8s.io/kustomize/api v0.8.8
+	sigs.k8s.io/yaml v1.2.0
 )
+
+// helm.sh/helm/v3 pins go-autorest the same way, its module and its split
+// submodules otherwise both provide the same packages.
+replace github.com/Azure/go-autorest => github.com/Azure/go-autorest v13.3.2+incompatible
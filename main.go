@@ -19,6 +19,8 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -29,6 +31,7 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -53,8 +56,47 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var gitWebhookAddr string
+	var syncInterval time.Duration
+	var applyMode string
+	var permissionCacheTTL time.Duration
+	var localRBAC bool
+	var allowedURLSchemes string
+	var requireCreator bool
+	var allowCrossNamespace bool
+	var privilegedIdentitiesPath string
+	var disablePrivileged bool
+	var workspace string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.DurationVar(&syncInterval, "sync-interval", 50*time.Second,
+		"How often MicroApplications are synced, unless they set spec.syncPolicy.interval.")
+	flag.StringVar(&applyMode, "apply-mode", string(controllers.ApplyModeImpersonate),
+		"How resources are applied on behalf of the creator of a MicroApplication: "+
+			"'sar' checks them with SubjectAccessReviews and applies them as the controller, "+
+			"'impersonate' applies them impersonating the creator.")
+	flag.DurationVar(&permissionCacheTTL, "permission-cache-ttl", 0,
+		"How long permission decisions are cached for, twice the --sync-interval by default so that they "+
+			"carry over to the next sync. 0 only shares decisions within a sync.")
+	flag.BoolVar(&localRBAC, "local-rbac-authorizer", false,
+		"Grant permissions from the RBAC rules in the controller's cache before falling back to SubjectAccessReviews.")
+	flag.BoolVar(&requireCreator, "require-creator", false,
+		"Refuse to sync MicroApplications without a recorded creator, instead of syncing them as the controller.")
+	flag.BoolVar(&allowCrossNamespace, "allow-cross-namespace", true,
+		"Let namespaced resources target another namespace than the destination namespace of their MicroApplication, "+
+			"unless its MicroProject sets allowCrossNamespace.")
+	flag.StringVar(&privilegedIdentitiesPath, "privileged-identities", "",
+		"Path to a YAML file listing the users and groups whose MicroApplications are synced without permission checks, "+
+			"e.g. a mounted ConfigMap. Defaults to the kube:admin user.")
+	flag.BoolVar(&disablePrivileged, "disable-privileged-identities", false,
+		"Check the permissions of every creator, leaving no privileged identity.")
+	flag.StringVar(&workspace, "workspace", filepath.Join(os.TempDir(), "micro-application"),
+		"The directory repositories are cloned to. It is kept across restarts and made readable by the controller only.")
+	flag.StringVar(&allowedURLSchemes, "allowed-url-schemes", strings.Join(argoprojiov1alpha1.DefaultAllowedURLSchemes, ","),
+		"Comma separated schemes of the repository URLs MicroApplications may use, e.g. https,ssh,http.")
+	flag.StringVar(&gitWebhookAddr, "git-webhook-bind-address", "",
+		"The address the Git push webhook receiver binds to. The receiver is disabled when empty. "+
+			"The webhook secret is read from the GIT_WEBHOOK_SECRET environment variable.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -63,10 +105,34 @@ func main() {
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
+	if !isFlagSet("permission-cache-ttl") {
+		permissionCacheTTL = 2 * syncInterval
+	}
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	u, _ := time.ParseDuration("50s")
+	switch controllers.ApplyMode(applyMode) {
+	case controllers.ApplyModeSubjectAccessReview, controllers.ApplyModeImpersonate:
+	default:
+		setupLog.Error(nil, "unknown apply mode, expected sar or impersonate", "apply-mode", applyMode)
+		os.Exit(1)
+	}
+
+	privileged := controllers.DefaultPrivilegedIdentities
+	switch {
+	case disablePrivileged && privilegedIdentitiesPath != "":
+		setupLog.Error(nil, "--privileged-identities and --disable-privileged-identities are mutually exclusive")
+		os.Exit(1)
+	case disablePrivileged:
+		privileged = nil
+	case privilegedIdentitiesPath != "":
+		var err error
+		privileged, err = controllers.LoadPrivilegedIdentities(privilegedIdentitiesPath)
+		if err != nil {
+			setupLog.Error(err, "unable to load privileged identities")
+			os.Exit(1)
+		}
+	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
@@ -75,21 +141,65 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "be709fb8.github.com",
-		SyncPeriod:             &u,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	// Without the mutating webhook, the creator recorded in a MicroApplication
+	// is whatever its author wrote there.
+	webhooksDisabled := os.Getenv("ENABLE_WEBHOOKS") == "false"
+	if webhooksDisabled && !requireCreator {
+		setupLog.Info("webhooks are disabled, MicroApplications are synced with the privileges of the controller unless --require-creator is set")
+	}
+
+	var pushEvents chan event.GenericEvent
+	if gitWebhookAddr != "" {
+		secret := os.Getenv("GIT_WEBHOOK_SECRET")
+		if secret == "" {
+			setupLog.Error(nil, "GIT_WEBHOOK_SECRET must be set when the git webhook receiver is enabled")
+			os.Exit(1)
+		}
+		pushEvents = make(chan event.GenericEvent, 1024)
+		if err = mgr.Add(&controllers.GitWebhookReceiver{
+			Client:  mgr.GetClient(),
+			Log:     ctrl.Log.WithName("webhooks").WithName("Git"),
+			Addr:    gitWebhookAddr,
+			Secret:  []byte(secret),
+			Events:  pushEvents,
+			Elected: mgr.Elected(),
+		}); err != nil {
+			setupLog.Error(err, "unable to create git webhook receiver")
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controllers.MicroApplicationReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("MicroApplication"),
-		Scheme: mgr.GetScheme(),
+		Client:              mgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("MicroApplication"),
+		Scheme:              mgr.GetScheme(),
+		DefaultSyncInterval: syncInterval,
+		PushEvents:          pushEvents,
+		ApplyMode:           controllers.ApplyMode(applyMode),
+		PermissionCacheTTL:  permissionCacheTTL,
+		LocalRBAC:           localRBAC,
+		RequireCreator:      requireCreator,
+		WebhooksDisabled:    webhooksDisabled,
+		AllowCrossNamespace: allowCrossNamespace,
+		Workspace:           workspace,
+		Privileged:          privileged,
+		Recorder:            mgr.GetEventRecorderFor("micro-application"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "MicroApplication")
 		os.Exit(1)
 	}
+	if !webhooksDisabled {
+		if err = (&argoprojiov1alpha1.MicroApplication{}).SetupWebhookWithManager(mgr, strings.Split(allowedURLSchemes, ",")); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "MicroApplication")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -107,3 +217,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// isFlagSet tells whether the flag named name was set on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}